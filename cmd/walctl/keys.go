@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/binjip978/wal"
+)
+
+// keyFile is a key provider with keys read from a file, every line holds
+// a key id and a hex encoded AES key, empty lines and lines starting
+// with # are skipped. The key with the largest id is the current one
+type keyFile struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (k *keyFile) CurrentKey() (uint32, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *keyFile) Key(id uint32) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, wal.ErrNoKey
+	}
+
+	return key, nil
+}
+
+// keysFlag adds the flag of the key file of an encrypted log
+func keysFlag(fs *flag.FlagSet) *string {
+	return fs.String("keys", "", "file with keys of an encrypted log, lines of key id and hex encoded key")
+}
+
+// readKeys reads a key file, it returns nil if path is empty
+func readKeys(path string) (wal.KeyProvider, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &keyFile{keys: make(map[uint32][]byte)}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", path, n)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key id %q", path, n, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			return nil, fmt.Errorf("%s:%d: key should be 16, 24 or 32 hex encoded bytes", path, n)
+		}
+
+		k.keys[uint32(id)] = key
+		if uint32(id) >= k.current {
+			k.current = uint32(id)
+		}
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return k, nil
+}
+
+// keysError explains how to read records of an encrypted log
+func keysError(err error) error {
+	return fmt.Errorf("%w: the log is encrypted, pass its keys with -keys", err)
+}
@@ -0,0 +1,429 @@
+// walctl inspects and repairs write ahead logs
+//
+// Usage:
+//
+//	walctl info <dir>
+//	walctl dump [-format hex|base64|json] [-from id] [-to id] [-keys file] <dir>
+//	walctl get [-format raw|hex|base64|json] [-keys file] <dir> <id>
+//	walctl verify <dir>
+//	walctl repair [-index-size n] [-store-size n] [-keys file] <dir>
+//	walctl trim [-before id] [-after id] [-index-size n] [-store-size n] <dir>
+//
+// info, dump, get and verify open the log read-only, repair and trim
+// modify it, the index size is taken from the active segment by default.
+// Records of encrypted logs are read with keys from the -keys file
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/binjip978/wal"
+)
+
+const usage = `usage: walctl <command> [flags] <dir>
+
+commands:
+  info     print segments, id ranges and sizes
+  dump     print records
+  get      print a single record
+  verify   check every record of the log
+  repair   rebuild indexes and drop corrupted records from the end of the log
+  trim     remove records before or after an id
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "walctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	commands := map[string]func([]string, io.Writer) error{
+		"info":   info,
+		"dump":   dump,
+		"get":    get,
+		"verify": verify,
+		"repair": repair,
+		"trim":   trim,
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+
+	return cmd(args[1:], out)
+}
+
+// parse parses command flags and returns positional arguments,
+// there should be exactly n of them
+func parse(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() != n {
+		return nil, fmt.Errorf("%s: expected %d arguments, got %d", fs.Name(), n, fs.NArg())
+	}
+
+	return fs.Args(), nil
+}
+
+// segmentFlags adds flags of segment sizes, they should match the config
+// of the writer, the active index file is resized to the index size on open.
+// Zero index size is replaced with the size of the active index by config
+func segmentFlags(fs *flag.FlagSet) *wal.Config {
+	cfg := &wal.Config{}
+	fs.Uint64Var(&cfg.Segment.MaxIndexSizeBytes, "index-size", 0, "max index size of a segment in bytes, the size of the active index by default")
+	fs.Uint64Var(&cfg.Segment.MaxStoreSizeBytes, "store-size", 1<<10, "max store size of a segment in bytes")
+	return cfg
+}
+
+// config returns cfg with the index size of the log in dir if it's not set
+func config(dir string, cfg *wal.Config) (*wal.Config, error) {
+	if cfg.Segment.MaxIndexSizeBytes != 0 {
+		return cfg, nil
+	}
+
+	w, err := wal.OpenReadOnly(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	stats := w.Stats()
+	active := stats.Segments[len(stats.Segments)-1]
+	cfg.Segment.MaxIndexSizeBytes = active.MaxIndexSizeBytes
+
+	return cfg, nil
+}
+
+func info(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := wal.OpenReadOnly(args[0], nil)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	stats := w.Stats()
+	fmt.Fprintf(out, "first id:       %d\n", stats.FirstID)
+	fmt.Fprintf(out, "last id:        %d\n", stats.LastID)
+	fmt.Fprintf(out, "active segment: %s\n", stats.ActiveSegment)
+	fmt.Fprintf(out, "segments:       %d\n\n", len(stats.Segments))
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEGMENT\tFIRST ID\tLAST ID\tRECORDS\tSTORE BYTES\tINDEX BYTES\tINDEX FILL")
+	for _, s := range stats.Segments {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%.1f%%\n", s.Name, s.FirstID,
+			s.FirstID+s.Records-1, s.Records, s.StoreBytes, s.IndexBytes, s.IndexFill*100)
+	}
+
+	return tw.Flush()
+}
+
+func dump(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	format := fs.String("format", "hex", "record format: hex, base64 or json")
+	from := fs.Uint64("from", 0, "first record id, the first id of the log by default")
+	to := fs.Uint64("to", 0, "last record id, the last id of the log by default")
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *format == "raw" {
+		return errors.New("dump: raw format is supported by get only")
+	}
+	cfg := &wal.Config{}
+	cfg.Encryption, err = readKeys(*keys)
+	if err != nil {
+		return err
+	}
+
+	w, err := wal.OpenReadOnly(args[0], cfg)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if *from == 0 {
+		*from = w.FirstID()
+	}
+	if *to == 0 {
+		*to = w.LastID()
+	}
+
+	it, err := w.NewIterator(*from)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		id, data := it.Record()
+		if id > *to {
+			break
+		}
+
+		err := printRecord(out, *format, id, data)
+		if err != nil {
+			return err
+		}
+	}
+	if errors.Is(it.Err(), wal.ErrNoKey) && *keys == "" {
+		return keysError(it.Err())
+	}
+
+	return it.Err()
+}
+
+func get(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	format := fs.String("format", "raw", "record format: raw, hex, base64 or json")
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	cfg := &wal.Config{}
+	cfg.Encryption, err = readKeys(*keys)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("get: invalid id %q", args[1])
+	}
+
+	w, err := wal.OpenReadOnly(args[0], cfg)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	data, err := w.Read(id)
+	if errors.Is(err, wal.ErrNoKey) && *keys == "" {
+		err = keysError(err)
+	}
+	if err != nil {
+		return fmt.Errorf("record %d: %w", id, err)
+	}
+
+	if *format == "raw" {
+		_, err := out.Write(data)
+		return err
+	}
+
+	return printRecord(out, *format, id, data)
+}
+
+// printRecord prints a record as a line of id and data, json lines
+// hold data encoded with base64
+func printRecord(out io.Writer, format string, id uint64, data []byte) error {
+	var err error
+	switch format {
+	case "hex":
+		_, err = fmt.Fprintf(out, "%d\t%s\n", id, hex.EncodeToString(data))
+	case "base64":
+		_, err = fmt.Fprintf(out, "%d\t%s\n", id, base64.StdEncoding.EncodeToString(data))
+	case "json":
+		err = json.NewEncoder(out).Encode(struct {
+			ID   uint64 `json:"id"`
+			Data []byte `json:"data"`
+		}{ID: id, Data: data})
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+
+	return err
+}
+
+func verify(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	report, err := wal.Verify(args[0])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEGMENT\tFIRST ID\tRECORDS\tSTORE BYTES\tINDEX BYTES")
+	for _, s := range report.Segments {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", s.Name, s.FirstID, s.Records, s.StoreBytes, s.IndexBytes)
+	}
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Fprintln(out, p)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d problems found, first: %w", len(report.Problems), report.Problems[0])
+	}
+
+	fmt.Fprintf(out, "ok: %d records, ids %d..%d\n", report.Records, report.FirstID, report.LastID)
+	return nil
+}
+
+// check reads every record of the log, it returns id of the last
+// valid record and the error that stopped it
+func check(w *wal.WAL) (uint64, error) {
+	first := w.FirstID()
+	lastID := w.LastID()
+	if lastID < first {
+		return lastID, nil
+	}
+
+	it, err := w.NewIterator(first)
+	if err != nil {
+		return first - 1, err
+	}
+	defer it.Close()
+
+	last := first - 1
+	for it.Next() {
+		id, _ := it.Record()
+		if id != last+1 {
+			return last, fmt.Errorf("unexpected id %d", id)
+		}
+		last = id
+	}
+	if it.Err() != nil {
+		return last, it.Err()
+	}
+	if last != lastID {
+		return last, wal.ErrRecordNotFound
+	}
+
+	return last, nil
+}
+
+func repair(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	cfg := segmentFlags(fs)
+	keys := keysFlag(fs)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	cfg, err = config(args[0], cfg)
+	if err != nil {
+		return err
+	}
+	cfg.Encryption, err = readKeys(*keys)
+	if err != nil {
+		return err
+	}
+
+	// opening the log recovers torn records at its tail and
+	// rebuilds indexes of sealed segments
+	w, err := wal.Repair(args[0], cfg)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	r := w.Recovery()
+	fmt.Fprintf(out, "recovery: dropped %d records, indexed %d records, truncated %d bytes, removed %d segments\n",
+		r.DroppedRecords, r.IndexedRecords, r.TruncatedBytes, r.RemovedSegments)
+
+	last, err := check(w)
+	if err == nil {
+		fmt.Fprintf(out, "ok: last id %d\n", last)
+		return nil
+	}
+	// records of an encrypted log are checked by decrypting them
+	if errors.Is(err, wal.ErrNoKey) && *keys == "" {
+		return fmt.Errorf("record %d: %w", last+1, keysError(err))
+	}
+	if !errors.Is(err, wal.ErrCorruptRecord) {
+		return fmt.Errorf("record %d: %w", last+1, err)
+	}
+	if last < w.FirstID() {
+		return fmt.Errorf("record %d: %w, no valid records to keep", last+1, err)
+	}
+
+	dropped := w.LastID() - last
+	err = w.TruncateAfter(last)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "truncated after %d: dropped %d records\n", last, dropped)
+	return nil
+}
+
+func trim(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("trim", flag.ContinueOnError)
+	before := fs.Uint64("before", 0, "remove records before id")
+	after := fs.Uint64("after", 0, "remove records after id")
+	cfg := segmentFlags(fs)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	// -after 0 removes all records of a log that starts with 1
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["before"] && !set["after"] {
+		return errors.New("trim: -before or -after should be set")
+	}
+	cfg, err = config(args[0], cfg)
+	if err != nil {
+		return err
+	}
+
+	w, err := wal.New(args[0], cfg)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if set["after"] {
+		err := w.TruncateAfter(*after)
+		if err != nil {
+			return fmt.Errorf("truncate after %d: %w", *after, err)
+		}
+	}
+	if set["before"] {
+		err := w.TruncateBefore(*before)
+		if err != nil {
+			return fmt.Errorf("truncate before %d: %w", *before, err)
+		}
+	}
+
+	fmt.Fprintf(out, "ids %d..%d\n", w.FirstID(), w.LastID())
+	return nil
+}
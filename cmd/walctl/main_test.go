@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/binjip978/wal"
+)
+
+func newLog(t *testing.T, n int) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "walctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := wal.New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		_, err := w.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestCommands(t *testing.T) {
+	dir := newLog(t, 5)
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	err := run([]string{"info", dir}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "last id:        5") {
+		t.Errorf("unexpected info output:\n%s", out.String())
+	}
+
+	out.Reset()
+	err = run([]string{"dump", "-format", "json", "-from", "2", "-to", "3", dir}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"id":2,"data":"cmVjb3JkIDI="}` + "\n" + `{"id":3,"data":"cmVjb3JkIDM="}` + "\n"
+	if out.String() != expected {
+		t.Errorf("unexpected dump output:\n%s", out.String())
+	}
+
+	out.Reset()
+	err = run([]string{"get", dir, "4"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "record 4" {
+		t.Errorf("unexpected get output: %q", out.String())
+	}
+
+	err = run([]string{"get", dir, "6"}, &out)
+	if !errors.Is(err, wal.ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound, got %v", err)
+	}
+
+	out.Reset()
+	err = run([]string{"trim", "-before", "2", "-after", "4", dir}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "ids 2..4\n" {
+		t.Errorf("unexpected trim output: %q", out.String())
+	}
+
+	err = run([]string{"unknown", dir}, &out)
+	if err == nil {
+		t.Error("unknown command should fail")
+	}
+}
+
+func TestVerifyRepair(t *testing.T) {
+	dir := newLog(t, 5)
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	err := run([]string{"verify", dir}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flip the last byte of the last record
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	if err != nil || len(stores) != 1 {
+		t.Fatalf("expected a single store, got %v: %v", stores, err)
+	}
+	b, err := ioutil.ReadFile(stores[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	err = ioutil.WriteFile(stores[0], b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = run([]string{"verify", dir}, &out)
+	if !errors.Is(err, wal.ErrCorruptRecord) {
+		t.Fatalf("verify should report corrupted record, got %v", err)
+	}
+
+	out.Reset()
+	err = run([]string{"repair", dir}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "dropped 1 records") {
+		t.Errorf("unexpected repair output:\n%s", out.String())
+	}
+
+	out.Reset()
+	err = run([]string{"verify", dir}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "ok: 4 records, ids 1..4\n") {
+		t.Errorf("unexpected verify output: %q", out.String())
+	}
+}
+
+func TestRepairIndexSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &wal.Config{}
+	cfg.Segment.MaxIndexSizeBytes = 64 << 10
+	cfg.Segment.MaxStoreSizeBytes = 64 << 10
+	w, err := wal.New(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 200; i++ {
+		_, err := w.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the index size is taken from the log or the index keeps its entries
+	for _, args := range [][]string{{"repair", dir}, {"repair", "-index-size", "1024", dir}} {
+		var out bytes.Buffer
+		err = run(args, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "ok: last id 200") {
+			t.Errorf("%v: unexpected repair output:\n%s", args, out.String())
+		}
+	}
+
+	out := bytes.Buffer{}
+	err = run([]string{"verify", dir}, &out)
+	if err != nil || !strings.HasSuffix(out.String(), "ok: 200 records, ids 1..200\n") {
+		t.Errorf("unexpected verify output: %q, %v", out.String(), err)
+	}
+}
+
+func TestEncryptedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// records 1..2 are encrypted with key 7 and records 3..5 with key 8
+	provider := &keyFile{current: 7, keys: map[uint32][]byte{
+		7: bytes.Repeat([]byte{0x2a}, 32),
+		8: bytes.Repeat([]byte{0x2b}, 32),
+	}}
+	cfg := &wal.Config{Encryption: provider}
+	cfg.Segment.MaxIndexSizeBytes = 1024
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	w, err := wal.New(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if i == 3 {
+			provider.current = 8
+		}
+		_, err := w.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := filepath.Join(dir, "keys")
+	err = ioutil.WriteFile(keys, []byte(fmt.Sprintf("# test keys\n7 %x\n8 %x\n", provider.keys[7], provider.keys[8])), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKeys := filepath.Join(dir, "wrong-keys")
+	err = ioutil.WriteFile(wrongKeys, []byte(fmt.Sprintf("7 %x\n8 %x\n", provider.keys[7], bytes.Repeat([]byte{1}, 32))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	for _, args := range [][]string{{"dump", dir}, {"get", dir, "2"}, {"repair", dir}} {
+		err = run(args, &out)
+		if !errors.Is(err, wal.ErrNoKey) || !strings.Contains(err.Error(), "-keys") {
+			t.Errorf("%v: should ask for keys, got %v", args, err)
+		}
+	}
+
+	out.Reset()
+	err = run([]string{"get", "-keys", keys, dir, "2"}, &out)
+	if err != nil || out.String() != "record 2" {
+		t.Errorf("unexpected get output: %q, %v", out.String(), err)
+	}
+
+	out.Reset()
+	err = run([]string{"dump", "-keys", keys, "-from", "5", dir}, &out)
+	if err != nil || out.String() != fmt.Sprintf("5\t%x\n", "record 5") {
+		t.Errorf("unexpected dump output: %q, %v", out.String(), err)
+	}
+
+	// flip the last byte of record 4, records have the same size
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	if err != nil || len(stores) != 1 {
+		t.Fatalf("expected a single store, got %v: %v", stores, err)
+	}
+	b, err := ioutil.ReadFile(stores[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := (len(b) - 32) / 5
+	b[32+4*frame-1] ^= 0xff
+	err = ioutil.WriteFile(stores[0], b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// records that can't be decrypted are not truncated
+	err = run([]string{"repair", "-keys", wrongKeys, dir}, &out)
+	if !errors.Is(err, wal.ErrWrongKey) || errors.Is(err, wal.ErrCorruptRecord) {
+		t.Errorf("repair with wrong keys should fail, got %v", err)
+	}
+	out.Reset()
+	err = run([]string{"get", "-keys", keys, dir, "5"}, &out)
+	if err != nil || out.String() != "record 5" {
+		t.Errorf("records should be kept: %q, %v", out.String(), err)
+	}
+
+	out.Reset()
+	err = run([]string{"repair", "-keys", keys, dir}, &out)
+	if err != nil || !strings.Contains(out.String(), "truncated after 3: dropped 2 records") {
+		t.Errorf("unexpected repair output:\n%s, %v", out.String(), err)
+	}
+}
@@ -0,0 +1,172 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	ErrInvalidCodec = errors.New("codec id should be in range 1..15")
+	ErrUnknownCodec = errors.New("record is compressed with unknown codec")
+)
+
+// Codec compresses records, its ID is stored in the upper four bits of
+// record flags, so every record is decoded with the codec it was written
+// with. Records of codecs other than Config.Compression are decoded with
+// codecs from the registry, see RegisterCodec
+type Codec interface {
+	// ID identifies the codec in records, it should be in range 1..15
+	ID() byte
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+const (
+	// codecShift is the position of the codec id in record flags
+	codecShift = 4
+	maxCodecID = 0xf
+)
+
+// Flate compresses records with DEFLATE, it's registered by default
+var Flate Codec = flateCodec{}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte {
+	return 1
+}
+
+func (flateCodec) Encode(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (flateCodec) Decode(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{Flate.ID(): Flate}
+)
+
+// RegisterCodec makes records written with c readable, ids of codecs
+// could not be reused
+func RegisterCodec(c Codec) error {
+	if c.ID() == 0 || c.ID() > maxCodecID {
+		return ErrInvalidCodec
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, ok := codecs[c.ID()]; ok {
+		return fmt.Errorf("%w: id %d is already registered", ErrInvalidCodec, c.ID())
+	}
+	codecs[c.ID()] = c
+
+	return nil
+}
+
+// codec returns the codec with id, the configured codec goes first
+func (w *WAL) codec(id byte) Codec {
+	if c := w.config.Compression; c != nil && c.ID() == id {
+		return c
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	return codecs[id]
+}
+
+// encode turns records into entries compressed with the configured codec
+// and encrypted if there is a key provider, records that don't get smaller
+// are stored uncompressed
+func (w *WAL) encode(records [][]byte) ([]entry, error) {
+	entries := make([]entry, len(records))
+	c := w.config.Compression
+
+	for i, data := range records {
+		e := entry{data: data}
+
+		if c != nil {
+			encoded, err := c.Encode(data)
+			if err != nil {
+				return nil, fmt.Errorf("can't compress record: %w", err)
+			}
+
+			if len(encoded) < len(data) {
+				e = entry{data: encoded, flags: c.ID() << codecShift}
+			}
+		}
+
+		if w.config.Encryption != nil {
+			e.flags |= flagEncrypted
+
+			var err error
+			e.data, err = w.encrypt(e.data, e.flags)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entries[i] = e
+	}
+
+	return entries, nil
+}
+
+// decode returns data of a record stored with flags
+func (w *WAL) decode(data []byte, flags byte) ([]byte, error) {
+	_, data, err := splitTimestamp(data, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&flagEncrypted != 0 {
+		data, err = w.decrypt(data, flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id := flags >> codecShift
+	if id == 0 {
+		return data, nil
+	}
+
+	c := w.codec(id)
+	if c == nil {
+		return nil, fmt.Errorf("%w: codec id %d", ErrUnknownCodec, id)
+	}
+
+	data, err = c.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decompress record: %v", ErrCorruptRecord, err)
+	}
+
+	return data, nil
+}
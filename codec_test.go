@@ -0,0 +1,155 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testCodec is a codec that is not registered by default
+type testCodec struct {
+	flateCodec
+}
+
+func (testCodec) ID() byte {
+	return 15
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 1024
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	cfg.Compression = Flate
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// record fits into a segment only when it is compressed
+	record := bytes.Repeat([]byte(`{"key":"value"},`), 100)
+	id, err := wal.Append(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := []byte{0x3f, 0x9a, 0x01, 0xc4}
+	_, err = wal.Append(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, h, err := wal.activeSegment.readRecord(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.flags>>codecShift != Flate.ID() || h.size >= uint64(len(record)) {
+		t.Errorf("record should be compressed, flags %x, size %d", h.flags, h.size)
+	}
+	_, h, err = wal.activeSegment.readRecord(id + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.flags != flagTimestamp {
+		t.Error("record that doesn't get smaller should be stored as is")
+	}
+	_ = wal.Close()
+
+	// records are readable without compression in config
+	wal, err = New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	data, err := wal.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, record) {
+		t.Error("record should be decompressed")
+	}
+
+	it, err := wal.NewIterator(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var records [][]byte
+	for it.Next() {
+		_, data := it.Record()
+		records = append(records, data)
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if len(records) != 2 || !bytes.Equal(records[0], record) || !bytes.Equal(records[1], random) {
+		t.Errorf("iterator should decompress records, got %q", records)
+	}
+}
+
+func TestCustomCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig
+	cfg.Compression = testCodec{}
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := bytes.Repeat([]byte("abc"), 100)
+	id, err := wal.Append(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := wal.Read(id)
+	if err != nil || !bytes.Equal(data, record) {
+		t.Errorf("record should be decoded with the configured codec, got %q, %v", data, err)
+	}
+	_ = wal.Close()
+
+	wal, err = New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	_, err = wal.Read(id)
+	if !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("should return ErrUnknownCodec, got %v", err)
+	}
+
+	err = RegisterCodec(testCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, testCodec{}.ID())
+		codecsMu.Unlock()
+	}()
+
+	_, err = wal.Read(id)
+	if err != nil {
+		t.Errorf("record should be decoded with the registered codec: %v", err)
+	}
+
+	err = RegisterCodec(Flate)
+	if !errors.Is(err, ErrInvalidCodec) {
+		t.Errorf("codec id should not be reused, got %v", err)
+	}
+}
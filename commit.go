@@ -0,0 +1,202 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrFailed is returned by appends after a failed write or truncation
+// couldn't be undone,
+// the log should be reopened to recover its tail
+var ErrFailed = errors.New("log can't undo a failed write")
+
+// appendRequest is an append waiting in the group commit queue
+type appendRequest struct {
+	// entries are encoded records
+	entries []entry
+	// id is the id of the first record
+	id   uint64
+	err  error
+	done bool
+}
+
+// enqueue adds request to the commit queue and waits until it's committed,
+// the request at the head of the queue becomes a leader, it takes every
+// queued request, writes them with a single store write and sync and wakes
+// up the rest, so concurrent appenders share the cost of one fsync
+func (w *WAL) enqueue(req *appendRequest) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+
+	w.queue = append(w.queue, req)
+	for !req.done && w.queue[0] != req {
+		w.queueCond.Wait()
+	}
+	if req.done {
+		return
+	}
+
+	// copy the batch, followers keep appending to the queue
+	batch := make([]*appendRequest, len(w.queue))
+	copy(batch, w.queue)
+
+	w.queueMu.Unlock()
+	w.commit(batch)
+	w.queueMu.Lock()
+
+	for _, r := range batch {
+		r.done = true
+	}
+	w.queue = w.queue[len(batch):]
+	w.queueCond.Broadcast()
+}
+
+// commit writes all records of the batch and syncs them according to
+// the sync policy, requests with records that can't fit into an empty
+// segment are rejected without affecting the rest of the batch
+func (w *WAL) commit(batch []*appendRequest) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if w.closed || w.failed != nil {
+		err := ErrClosed
+		if !w.closed {
+			err = w.failed
+		}
+		for _, req := range batch {
+			req.err = err
+		}
+		return
+	}
+
+	var entries []entry
+	var reqs []*appendRequest
+	ts := w.timestamp()
+	for _, req := range batch {
+		if !w.fits(req.entries) {
+			req.err = ErrRecordTooLarge
+			continue
+		}
+
+		// every record except the last one is marked, so recovery
+		// could drop a batch that was not written completely
+		for i, e := range req.entries {
+			e = stamp(e, ts)
+			if i < len(req.entries)-1 {
+				e.flags |= flagBatch
+			}
+			entries = append(entries, e)
+		}
+		reqs = append(reqs, req)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	// records that are not acknowledged should not be published by
+	// the next commit, a batch could be written partially too
+	m := w.mark()
+	id, err := w.write(entries)
+	if err == nil {
+		err = w.maybeSync()
+	}
+	if err != nil {
+		w.rollback(m)
+	} else {
+		w.publish()
+	}
+
+	for _, req := range reqs {
+		req.id = id
+		req.err = err
+		id += uint64(len(req.entries))
+	}
+}
+
+// fits reports whether every record could be written into an empty
+// segment, records get their append time when they are committed
+func (w *WAL) fits(entries []entry) bool {
+	for _, e := range entries {
+		size := uint64(len(e.data)) + timestampSize
+		if size > maxRecordSize || size+recordHeaderSize > w.config.Segment.MaxStoreSizeBytes {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mark is the end of the log before a commit
+type mark struct {
+	segments int
+	id       uint64
+	size     uint64
+	unsynced uint64
+}
+
+func (w *WAL) mark() mark {
+	return mark{
+		segments: len(w.segments),
+		id:       w.activeSegment.idx.id,
+		size:     w.activeSegment.store.size,
+		unsynced: w.unsynced,
+	}
+}
+
+// rollback removes records written after m and segments created for them,
+// if it fails the log doesn't know what is written and rejects appends
+func (w *WAL) rollback(m mark) {
+	err := w.undo(m)
+	if err != nil {
+		w.failed = fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+}
+
+func (w *WAL) undo(m mark) error {
+	if len(w.segments) > m.segments {
+		for len(w.segments) > m.segments {
+			last := w.segments[len(w.segments)-1]
+			err := last.remove()
+			if err != nil {
+				return err
+			}
+
+			w.mu.Lock()
+			w.segments = w.segments[:len(w.segments)-1]
+			w.activeSegment = w.segments[len(w.segments)-1]
+			w.mu.Unlock()
+
+			err = last.release()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := w.config.FS.SyncDir(w.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// index entries that point past the store are dropped by recovery,
+	// the store goes first so records are not indexed again
+	s := w.activeSegment
+	if s.store.size > m.size {
+		err := s.store.truncate(m.size)
+		if err != nil {
+			return err
+		}
+	}
+	if s.idx.id > m.id {
+		err := s.idx.truncate(m.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.unsynced = m.unsynced
+	w.activeTime = 0
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-group-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 16 * 4
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hold the log so appenders pile up in the queue
+	wal.writeMu.Lock()
+
+	const appenders = 10
+	ids := make([]uint64, appenders)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := wal.Append([]byte(fmt.Sprintf("record-%d", i)))
+			if err != nil {
+				t.Error(err)
+			}
+			ids[i] = id
+		}(i)
+	}
+
+	for {
+		wal.queueMu.Lock()
+		n := len(wal.queue)
+		wal.queueMu.Unlock()
+		if n == appenders {
+			break
+		}
+	}
+	wal.writeMu.Unlock()
+	wg.Wait()
+
+	if len(wal.queue) != 0 {
+		t.Error("queue should be empty")
+	}
+	if wal.unsynced != 0 {
+		t.Error("all records should be synced")
+	}
+
+	seen := make(map[uint64]bool)
+	for i, id := range ids {
+		if id < 1 || id > appenders || seen[id] {
+			t.Fatalf("wrong id %d", id)
+		}
+		seen[id] = true
+
+		data, err := wal.Read(id)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(data) != fmt.Sprintf("record-%d", i) {
+			t.Error("read is not right")
+		}
+	}
+
+	// batch of 10 records doesn't fit into 4 entries index
+	if len(wal.segments) != 3 {
+		t.Errorf("should have 3 segments, got %d", len(wal.segments))
+	}
+}
+
+func TestGroupCommitTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-group-commit-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 1024
+	cfg.Segment.MaxStoreSizeBytes = 32
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := &appendRequest{entries: []entry{{data: []byte("small")}}}
+	large := &appendRequest{entries: []entry{{data: make([]byte, 32)}}}
+	wal.commit([]*appendRequest{small, large})
+
+	if small.err != nil || small.id != 1 {
+		t.Errorf("small record should be committed: %v", small.err)
+	}
+	if !errors.Is(large.err, ErrRecordTooLarge) {
+		t.Errorf("large record should be rejected with ErrRecordTooLarge, got %v", large.err)
+	}
+	if len(wal.segments) != 1 {
+		t.Error("rejected record should not roll the segment")
+	}
+}
+
+func TestAppendTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-too-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 64
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// fill the active segment so a record that fits would roll it
+	for i := 0; i < 2; i++ {
+		_, err = wal.Append([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = wal.Append(make([]byte, 64))
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("should return ErrRecordTooLarge, got %v", err)
+	}
+
+	_, _, err = wal.AppendBatch([][]byte{[]byte("data"), make([]byte, 64-recordHeaderSize+1)})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("should return ErrRecordTooLarge, got %v", err)
+	}
+
+	if wal.LastID() != 2 || wal.SegmentCount() != 1 {
+		t.Errorf("rejected records should not be written, last id %d, %d segments", wal.LastID(), wal.SegmentCount())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("rejected records should not create segments, got %d files", len(files))
+	}
+
+	// the largest record still fits
+	id, err := wal.Append(make([]byte, 64-recordHeaderSize-timestampSize))
+	if err != nil || id != 3 {
+		t.Errorf("record should be appended, got %d, %v", id, err)
+	}
+}
+
+func TestFailedAppendIsNotPublished(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 1024
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	// fail every operation of an append in turn
+	for n := 1; ; n++ {
+		fs := newFaultFS(0)
+		cfg.FS = fs
+
+		wal, err := New("/wal", &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wal.Append([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs.failAfter(n)
+		_, err = wal.Append([]byte("b"))
+		if err == nil {
+			_ = wal.Close()
+			break
+		}
+		if !errors.Is(err, errFault) {
+			t.Fatalf("operation %d: unexpected error %v", n, err)
+		}
+
+		id, err := wal.Append([]byte("c"))
+		if err != nil || id != 2 {
+			t.Fatalf("operation %d: append after a failed one should get id 2, got %d, %v", n, id, err)
+		}
+
+		// the log is the same after it's reopened
+		for i := 0; i < 2; i++ {
+			if wal.LastID() != 2 {
+				t.Fatalf("operation %d: failed append should not be visible, last id %d", n, wal.LastID())
+			}
+			data, err := wal.Read(2)
+			if err != nil || string(data) != "c" {
+				t.Fatalf("operation %d: wrong record 2: %q, %v", n, data, err)
+			}
+
+			err = wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wal, err = New("/wal", &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = wal.Close()
+	}
+}
@@ -1,5 +1,7 @@
 package wal
 
+import "time"
+
 const (
 	defaultStoreSize = 1 << 10
 	defaultIndexSize = 1 << 10
@@ -11,10 +13,83 @@ type Config struct {
 	Segment struct {
 		MaxStoreSizeBytes uint64
 		MaxIndexSizeBytes uint64
+		// MaxAge rolls the active segment on append once it's older,
+		// segments are rolled only when they are full if it's zero
+		MaxAge time.Duration
+	}
+	// Sync defines when appended records are flushed to disk,
+	// zero value is SyncAlways
+	Sync SyncPolicy
+	// Compression is the codec that compresses appended records,
+	// records are not compressed if it's nil
+	Compression Codec
+	// Encryption provides keys to encrypt appended records and to decrypt
+	// encrypted records, records are not encrypted if it's nil
+	Encryption KeyProvider
+	// FS is the file system the log is stored in, OSFS if it's nil
+	FS FS
+
+	// readOnly is set by OpenReadOnly, files are opened for reading
+	// and never created, truncated or written
+	readOnly bool
+	// repair is set by Repair, indexes of sealed segments are rebuilt
+	repair bool
+}
+
+// fs returns the file system of the log
+func (c *Config) fs() FS {
+	if c.FS == nil {
+		return OSFS
 	}
+
+	return c.FS
 }
 
 var defaultConfig = Config{Segment: struct {
 	MaxStoreSizeBytes uint64
 	MaxIndexSizeBytes uint64
+	MaxAge            time.Duration
 }{MaxStoreSizeBytes: defaultStoreSize, MaxIndexSizeBytes: defaultIndexSize}}
+
+type syncMode int
+
+const (
+	syncAlways syncMode = iota
+	syncEveryN
+	syncInterval
+	syncNever
+)
+
+// SyncPolicy is a trade-off between durability and append latency,
+// records that are not synced yet could be lost on power failure
+type SyncPolicy struct {
+	mode     syncMode
+	n        uint64
+	interval time.Duration
+}
+
+var (
+	// SyncAlways flushes store and index on every append
+	SyncAlways = SyncPolicy{mode: syncAlways}
+	// SyncNever leaves flushing to the OS, WAL.Sync, WAL.Close and
+	// segment rotation
+	SyncNever = SyncPolicy{mode: syncNever}
+)
+
+// SyncEveryN flushes store and index once per n appends
+func SyncEveryN(n uint64) SyncPolicy {
+	if n <= 1 {
+		return SyncAlways
+	}
+
+	return SyncPolicy{mode: syncEveryN, n: n}
+}
+
+// SyncInterval flushes store and index in the background every d
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+
+	return SyncPolicy{mode: syncInterval, interval: d}
+}
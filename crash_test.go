@@ -0,0 +1,493 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// crashModel tracks what the log may and must hold after a crash or a
+// failed operation of the workload
+type crashModel struct {
+	nextID uint64
+	// live holds acknowledged records that are not truncated
+	live map[uint64][]byte
+	// allowed holds data every id could have
+	allowed map[uint64][][]byte
+	// durable holds records that must survive a crash
+	durable map[uint64][]byte
+	// firstID is the lowest first id of the log
+	firstID uint64
+	// batches maps data of a record to records of its batch
+	batches map[string][][]byte
+	// failed holds data of failed appends, it must never be visible
+	failed [][]byte
+	// acked is the number of acknowledged appends
+	acked int
+	// errs is the number of failed operations
+	errs int
+	// failedOp is the first operation that failed
+	failedOp string
+	// opened is the number of file system operations made by New
+	opened int
+	// stopped is set if appends failed with ErrFailed
+	stopped bool
+	// visible is the result of checking the log before it's closed
+	visible error
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{
+		nextID:  1,
+		live:    make(map[uint64][]byte),
+		allowed: make(map[uint64][][]byte),
+		durable: make(map[uint64][]byte),
+		firstID: 1,
+		batches: make(map[string][][]byte),
+	}
+}
+
+// append makes records of batch allowed, they are acknowledged by ack
+func (m *crashModel) append(batch [][]byte) {
+	for i, record := range batch {
+		id := m.nextID + uint64(i)
+		m.allowed[id] = append(m.allowed[id], record)
+		m.batches[string(record)] = batch
+	}
+}
+
+// ack acknowledges batch that is appended at id
+func (m *crashModel) ack(id uint64, batch [][]byte, durable bool) error {
+	if id != m.nextID {
+		return fmt.Errorf("batch is appended at %d, expected %d", id, m.nextID)
+	}
+	for i, record := range batch {
+		m.live[id+uint64(i)] = record
+	}
+	m.nextID += uint64(len(batch))
+	m.acked++
+	if durable {
+		m.sync()
+	}
+
+	return nil
+}
+
+// fail makes records of a failed batch not allowed
+func (m *crashModel) fail(batch [][]byte) {
+	for i := range batch {
+		id := m.nextID + uint64(i)
+		m.allowed[id] = m.allowed[id][:len(m.allowed[id])-1]
+	}
+	m.failed = append(m.failed, batch...)
+}
+
+// failure counts a failed operation
+func (m *crashModel) failure(op string) {
+	if m.errs == 0 {
+		m.failedOp = op
+	}
+	m.errs++
+}
+
+// sync makes live records durable
+func (m *crashModel) sync() {
+	m.durable = make(map[uint64][]byte)
+	for id, record := range m.live {
+		m.durable[id] = record
+	}
+}
+
+// truncatingAfter removes records after id from live ones, they could be
+// gone before the truncation is acknowledged
+func (m *crashModel) truncatingAfter(id uint64) {
+	for i := id + 1; i < m.nextID; i++ {
+		delete(m.live, i)
+		delete(m.durable, i)
+	}
+}
+
+// truncateAfter removes records after id, what is left is durable
+func (m *crashModel) truncateAfter(id uint64) {
+	for i := id + 1; i < m.nextID; i++ {
+		delete(m.live, i)
+		delete(m.allowed, i)
+	}
+	m.nextID = id + 1
+	m.sync()
+}
+
+// truncateBefore removes records before id, they could be gone before
+// the truncation is acknowledged
+func (m *crashModel) truncateBefore(id uint64) {
+	for i := range m.live {
+		if i < id {
+			delete(m.live, i)
+			delete(m.durable, i)
+		}
+	}
+}
+
+// crashOptions changes the workload
+type crashOptions struct {
+	// prefill is the number of records appended before the workload
+	prefill int
+	// crashAt is the operation after prefilled records the file system
+	// crashes at, if it's not zero
+	crashAt int
+	// fail is the operation after prefilled records that fails, if it's
+	// not zero, the workload continues after it
+	fail int
+}
+
+// crashWorkload appends single records and batches, syncs and truncates
+// the log until it crashes
+func crashWorkload(fs *faultFS, cfg Config, opts crashOptions) *crashModel {
+	cfg.FS = fs
+	m := newCrashModel()
+	durable := cfg.Sync == SyncAlways
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		return m
+	}
+
+	for i := 0; i < opts.prefill; i++ {
+		batch := [][]byte{[]byte(fmt.Sprintf("prefill %d", i))}
+		m.append(batch)
+		id, err := wal.Append(batch[0])
+		if err != nil {
+			m.failure("prefill")
+			return m
+		}
+		err = m.ack(id, batch, durable)
+		if err != nil {
+			m.failure("ack")
+			return m
+		}
+	}
+	m.acked = 0
+
+	m.opened = fs.ops
+	if opts.crashAt > 0 {
+		fs.crashAfter(opts.crashAt)
+	}
+	if opts.fail > 0 {
+		fs.failAfter(opts.fail)
+	}
+
+	// ids of batches appended at every step
+	var steps [][2]uint64
+	for i := 0; i < 12; i++ {
+		n := 1
+		if i%3 == 2 {
+			n = 3
+		}
+
+		var batch [][]byte
+		for j := 0; j < n; j++ {
+			id := i*10 + j
+			batch = append(batch, bytes.Repeat([]byte(fmt.Sprintf("%d,", id)), 40+id%7*30))
+		}
+
+		m.append(batch)
+		var id uint64
+		if n == 1 {
+			id, err = wal.Append(batch[0])
+		} else {
+			id, _, err = wal.AppendBatch(batch)
+		}
+		if fs.crashErr() != nil {
+			return m
+		}
+		if errors.Is(err, ErrFailed) {
+			m.stopped = true
+			break
+		}
+		if err != nil {
+			m.fail(batch)
+			m.failure("append")
+			continue
+		}
+		err = m.ack(id, batch, durable)
+		if err != nil {
+			m.failure("ack")
+			return m
+		}
+		steps = append(steps, [2]uint64{id, id + uint64(n) - 1})
+
+		op := "sync"
+		switch i {
+		case 3, 10:
+			err = wal.Sync()
+			if err == nil {
+				m.sync()
+			}
+		case 5:
+			// the last two batches, they could span segments
+			after := steps[len(steps)-3][1]
+			m.truncatingAfter(after)
+			op = "truncate after"
+			err = wal.TruncateAfter(after)
+			if err == nil {
+				m.truncateAfter(after)
+				steps = steps[:len(steps)-2]
+			}
+		case 8:
+			before := steps[2][0]
+			m.truncateBefore(before)
+			op = "truncate before"
+			err = wal.TruncateBefore(before)
+			if err == nil {
+				m.firstID = before
+			}
+		}
+		if fs.crashErr() != nil {
+			return m
+		}
+		if err != nil {
+			m.failure(op)
+		}
+	}
+
+	// a log that failed to truncate is read after it's reopened
+	if opts.fail > 0 && m.failedOp != "truncate after" {
+		// everything acknowledged is visible, failed appends are not
+		live := *m
+		live.durable = m.live
+		m.visible = checkLog(wal, &live)
+	}
+
+	err = wal.Close()
+	if err != nil && fs.crashErr() == nil {
+		m.failure("close")
+	}
+
+	return m
+}
+
+// checkLog checks that the log holds whole batches it's allowed to hold,
+// durable records and no failed appends
+func checkLog(wal *WAL, m *crashModel) error {
+	first := wal.FirstID()
+	if first < m.firstID {
+		return fmt.Errorf("log starts with %d, records before %d are truncated", first, m.firstID)
+	}
+
+	it, err := wal.NewIterator(first)
+	if err != nil {
+		return err
+	}
+	records := make(map[uint64][]byte)
+	var batch [][]byte
+	next := first
+	for it.Next() {
+		id, data := it.Record()
+		if id != next {
+			_ = it.Close()
+			return fmt.Errorf("read record %d, expected %d", id, next)
+		}
+		next++
+
+		for _, record := range m.failed {
+			if bytes.Equal(data, record) {
+				_ = it.Close()
+				return fmt.Errorf("record %d was not appended", id)
+			}
+		}
+		allowed := false
+		for _, record := range m.allowed[id] {
+			allowed = allowed || bytes.Equal(data, record)
+		}
+		if !allowed {
+			_ = it.Close()
+			return fmt.Errorf("record %d doesn't match appended records", id)
+		}
+
+		if len(batch) == 0 {
+			batch = m.batches[string(data)]
+			if !bytes.Equal(batch[0], data) {
+				_ = it.Close()
+				return fmt.Errorf("record %d starts a batch partially", id)
+			}
+		} else if !bytes.Equal(batch[0], data) {
+			_ = it.Close()
+			return fmt.Errorf("record %d doesn't match its batch", id)
+		}
+		batch = batch[1:]
+		records[id] = data
+	}
+	_ = it.Close()
+	if it.Err() != nil {
+		return fmt.Errorf("can't read log: %w", it.Err())
+	}
+	if len(batch) != 0 {
+		return fmt.Errorf("batch is recovered partially")
+	}
+	if next != wal.LastID()+1 {
+		return fmt.Errorf("log has ids %d..%d, read %d records", first, wal.LastID(), next-first)
+	}
+
+	for id, record := range m.durable {
+		if !bytes.Equal(records[id], record) {
+			return fmt.Errorf("durable record %d is lost", id)
+		}
+	}
+
+	return nil
+}
+
+// checkRecovered opens the recovered log, checks it and that it's usable
+func checkRecovered(t *testing.T, fs FS, cfg Config, m *crashModel) {
+	t.Helper()
+	cfg.FS = fs
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatalf("can't open recovered log: %v", err)
+	}
+	defer wal.Close()
+
+	err = checkLog(wal, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := wal.Append([]byte("after crash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := wal.Read(id)
+	if err != nil || string(data) != "after crash" {
+		t.Fatalf("can't read record appended after recovery: %q, %v", data, err)
+	}
+}
+
+var crashPolicies = []struct {
+	name   string
+	policy SyncPolicy
+}{
+	{"always", SyncAlways},
+	{"every 3", SyncEveryN(3)},
+	{"never", SyncNever},
+}
+
+func crashConfig(policy SyncPolicy) Config {
+	cfg := Config{Sync: policy}
+	cfg.Segment.MaxIndexSizeBytes = 64
+	cfg.Segment.MaxStoreSizeBytes = 2048
+
+	return cfg
+}
+
+func TestCrashRecovery(t *testing.T) {
+	modes := []struct {
+		name string
+		mode crashMode
+	}{
+		{"drop unsynced", dropUnsynced},
+		{"keep unsynced", keepUnsynced},
+		{"torn write", tornWrite},
+	}
+
+	for _, p := range crashPolicies {
+		cfg := crashConfig(p.policy)
+
+		// count operations of the workload without crashes
+		fs := newFaultFS(0)
+		m := crashWorkload(fs, cfg, crashOptions{})
+		if m.acked != 12 || m.errs != 0 {
+			t.Fatalf("%s: workload should succeed without crashes", p.name)
+		}
+		ops := fs.ops
+
+		for crashAt := 1; crashAt <= ops; crashAt++ {
+			fs := newFaultFS(crashAt)
+			m := crashWorkload(fs, cfg, crashOptions{})
+			if !errors.Is(fs.crashErr(), errCrash) {
+				t.Fatalf("%s: log should crash at operation %d", p.name, crashAt)
+			}
+			if m.errs != 0 {
+				t.Fatalf("%s: operations should fail only after the crash at %d", p.name, crashAt)
+			}
+
+			for _, mode := range modes {
+				t.Run(fmt.Sprintf("%s/%s/%d", p.name, mode.name, crashAt), func(t *testing.T) {
+					checkRecovered(t, fs.recover(mode.mode), cfg, m)
+				})
+			}
+		}
+	}
+}
+
+func TestCrashIndexPages(t *testing.T) {
+	// the first page of the index holds 254 entries, the first batch of
+	// the workload comes after two single records and spans its pages
+	const prefill = (pageSize-headerSize)/16 - 3
+
+	for _, p := range crashPolicies {
+		cfg := Config{Sync: p.policy}
+		cfg.Segment.MaxIndexSizeBytes = 2 * pageSize
+		cfg.Segment.MaxStoreSizeBytes = 64 << 10
+
+		fs := newFaultFS(0)
+		m := crashWorkload(fs, cfg, crashOptions{prefill: prefill})
+		if m.acked != 12 || m.errs != 0 {
+			t.Fatalf("%s: workload should succeed without crashes", p.name)
+		}
+		ops := fs.ops - m.opened
+
+		for crashAt := 1; crashAt <= ops; crashAt++ {
+			fs := newFaultFS(0)
+			m := crashWorkload(fs, cfg, crashOptions{prefill: prefill, crashAt: crashAt})
+			if !errors.Is(fs.crashErr(), errCrash) {
+				t.Fatalf("%s: log should crash at operation %d", p.name, crashAt)
+			}
+			if m.errs != 0 {
+				t.Fatalf("%s: operations should fail only after the crash at %d", p.name, crashAt)
+			}
+
+			// every subset of changed pages of the first ones
+			pages := fs.dirtyPages()
+			if pages > 4 {
+				pages = 4
+			}
+			for keep := uint64(0); keep < 1<<uint(pages); keep++ {
+				t.Run(fmt.Sprintf("%s/%d/%b", p.name, crashAt, keep), func(t *testing.T) {
+					checkRecovered(t, fs.recoverPages(keep), cfg, m)
+				})
+			}
+		}
+	}
+}
+
+func TestFailedOperation(t *testing.T) {
+	for _, p := range crashPolicies {
+		cfg := crashConfig(p.policy)
+
+		fs := newFaultFS(0)
+		m := crashWorkload(fs, cfg, crashOptions{})
+		ops := fs.ops - m.opened
+
+		for fail := 1; fail <= ops; fail++ {
+			t.Run(fmt.Sprintf("%s/%d", p.name, fail), func(t *testing.T) {
+				fs := newFaultFS(0)
+				m := crashWorkload(fs, cfg, crashOptions{fail: fail})
+				if m.errs > 1 || m.failedOp == "ack" {
+					t.Fatalf("log should continue after a failed operation, %d operations failed", m.errs)
+				}
+				if m.stopped && m.failedOp != "truncate after" {
+					t.Fatalf("appends should fail only after a failed truncation, %s failed", m.failedOp)
+				}
+				if m.visible != nil {
+					t.Fatal(m.visible)
+				}
+
+				// the file system didn't crash, everything acknowledged is there
+				m.durable = m.live
+				checkRecovered(t, fs, cfg, m)
+			})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrNoKey = errors.New("record is encrypted and there is no key for it")
+	// ErrWrongKey is returned if a record doesn't decrypt with the key of
+	// its key id, checksums of records are verified before they are
+	// decrypted, so it means the key is wrong rather than the record
+	ErrWrongKey = errors.New("record can't be decrypted with its key")
+)
+
+// KeyProvider supplies keys for record encryption, keys are AES-128,
+// AES-192 or AES-256 keys. Records are encrypted with the current key
+// and its id is stored with every record, so keys could be rotated while
+// records encrypted with older keys are decrypted with them
+type KeyProvider interface {
+	// CurrentKey returns the key for new records and its id
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with id, ErrNoKey if there is no such key
+	Key(id uint32) ([]byte, error)
+}
+
+const (
+	keyIDSize = 4
+	nonceSize = 12
+)
+
+// encrypt seals data with the current key, encrypted data structure:
+// [keyID (4 bytes)][nonce (12 bytes)][ciphertext with AES-GCM tag],
+// record flags are authenticated too except flagBatch and flagTimestamp,
+// they are set when the record is committed after it's encrypted
+func (w *WAL) encrypt(data []byte, flags byte) ([]byte, error) {
+	id, key, err := w.config.Encryption.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("can't get encryption key: %w", err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, keyIDSize+nonceSize, keyIDSize+nonceSize+len(data)+aead.Overhead())
+	binary.BigEndian.PutUint32(b[0:keyIDSize], id)
+	_, err = io.ReadFull(rand.Reader, b[keyIDSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(b, b[keyIDSize:], data, []byte{flags &^ (flagBatch | flagTimestamp)}), nil
+}
+
+// decrypt opens data of a record stored with flags
+func (w *WAL) decrypt(data []byte, flags byte) ([]byte, error) {
+	if w.config.Encryption == nil {
+		return nil, ErrNoKey
+	}
+	if len(data) < keyIDSize+nonceSize {
+		return nil, fmt.Errorf("%w: short encrypted record", ErrCorruptRecord)
+	}
+
+	id := binary.BigEndian.Uint32(data[0:keyIDSize])
+	key, err := w.config.Encryption.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %w", id, err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := data[keyIDSize : keyIDSize+nonceSize]
+	data, err = aead.Open(nil, nonce, data[keyIDSize+nonceSize:], []byte{flags &^ (flagBatch | flagTimestamp)})
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d", ErrWrongKey, id)
+	}
+
+	return data, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKeys is a key provider with static keys
+type testKeys struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (k *testKeys) CurrentKey() (uint32, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrNoKey
+	}
+
+	return key, nil
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := &testKeys{current: 1, keys: map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+	}}
+
+	cfg := defaultConfig
+	cfg.Encryption = keys
+	cfg.Compression = Flate
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := bytes.Repeat([]byte("secret "), 20)
+	_, err = wal.Append(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is rotated, old records are still readable
+	keys.current = 2
+	keys.keys[2] = bytes.Repeat([]byte{2}, 16)
+	_, err = wal.Append([]byte("plain text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = wal.Close()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, segmentName(1)+".store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("plain text")) {
+		t.Error("store should not hold plain text")
+	}
+
+	wal, err = OpenReadOnly(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[uint64][]byte{1: secret, 2: []byte("plain text")} {
+		data, err := wal.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("record %d: got %q", id, data)
+		}
+	}
+	_ = wal.Close()
+
+	wal, err = OpenReadOnly(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wal.Read(1)
+	if !errors.Is(err, ErrNoKey) {
+		t.Errorf("should return ErrNoKey, got %v", err)
+	}
+	_ = wal.Close()
+
+	// a different key with the same id
+	cfg.Encryption = &testKeys{current: 1, keys: map[uint32][]byte{
+		1: bytes.Repeat([]byte{3}, 32),
+	}}
+	wal, err = OpenReadOnly(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	_, err = wal.Read(1)
+	if !errors.Is(err, ErrWrongKey) || errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("should return ErrWrongKey, got %v", err)
+	}
+	_, err = wal.Read(2)
+	if !errors.Is(err, ErrNoKey) {
+		t.Errorf("should return ErrNoKey, got %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	errCrash = errors.New("simulated crash")
+	errFault = errors.New("simulated fault")
+)
+
+// crashMode defines what happens to data that was not synced on crash
+type crashMode int
+
+const (
+	// dropUnsynced loses every write, file creation, rename and removal
+	// that was not synced
+	dropUnsynced crashMode = iota
+	// keepUnsynced keeps everything, as if the page cache was written back
+	keepUnsynced
+	// tornWrite keeps everything except the second half of the last append
+	// to every file, appends are torn at sector boundaries
+	tornWrite
+)
+
+const (
+	sectorSize = 512
+	// pageSize is the unit mapped files are written back in
+	pageSize = 4096
+)
+
+// faultFS is a memory file system that crashes at the n-th operation that
+// changes it, operations after the crash fail with errCrash. It tracks what
+// is synced, so the state of the file system after the crash could be built
+type faultFS struct {
+	*memFS
+
+	mu      sync.Mutex
+	crashAt int
+	// failAt is the operation that fails without a crash
+	failAt  int
+	ops     int
+	crashed bool
+	// durable holds file data as of the last sync
+	durable map[*memData][]byte
+	// durableDir holds directory entries as of the last directory sync
+	durableDir map[string]*memData
+	// lastWrite is the last write to a file after its last sync
+	lastWrite map[*memData]write
+	// mapped holds files that are mapped into memory
+	mapped map[*memData]bool
+}
+
+type write struct {
+	off, n int64
+	// append is set if the write extended the file
+	append bool
+}
+
+// newFaultFS returns a file system that crashes at the crashAt operation,
+// zero means it never crashes
+func newFaultFS(crashAt int) *faultFS {
+	return &faultFS{
+		memFS:      NewMemFS().(*memFS),
+		crashAt:    crashAt,
+		durable:    make(map[*memData][]byte),
+		durableDir: make(map[string]*memData),
+		lastWrite:  make(map[*memData]write),
+		mapped:     make(map[*memData]bool),
+	}
+}
+
+// op counts an operation that changes the file system
+func (fs *faultFS) op() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.crashed {
+		return errCrash
+	}
+
+	fs.ops++
+	if fs.ops == fs.crashAt {
+		fs.crashed = true
+		return errCrash
+	}
+	if fs.ops == fs.failAt {
+		return errFault
+	}
+
+	return nil
+}
+
+// failAfter makes the n-th operation from now fail with errFault,
+// operations after it succeed
+func (fs *faultFS) failAfter(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.failAt = fs.ops + n
+}
+
+// crashAfter makes the file system crash at the n-th operation from now
+func (fs *faultFS) crashAfter(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.crashAt = fs.ops + n
+}
+
+// sync makes data of d durable
+func (fs *faultFS) sync(d *memData) {
+	d.mu.RLock()
+	data := append([]byte(nil), d.data...)
+	d.mu.RUnlock()
+
+	fs.mu.Lock()
+	fs.durable[d] = data
+	delete(fs.lastWrite, d)
+	fs.mu.Unlock()
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		err := fs.op()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := fs.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: f, fs: fs, d: f.(*memFile).d}, nil
+}
+
+func (fs *faultFS) Remove(name string) error {
+	err := fs.op()
+	if err != nil {
+		return err
+	}
+
+	return fs.memFS.Remove(name)
+}
+
+func (fs *faultFS) Rename(oldname, newname string) error {
+	err := fs.op()
+	if err != nil {
+		return err
+	}
+
+	return fs.memFS.Rename(oldname, newname)
+}
+
+func (fs *faultFS) SyncDir(dir string) error {
+	err := fs.op()
+	if err != nil {
+		return err
+	}
+
+	dir = filepath.Clean(dir)
+
+	fs.memFS.mu.Lock()
+	defer fs.memFS.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for name := range fs.durableDir {
+		if filepath.Dir(name) == dir {
+			delete(fs.durableDir, name)
+		}
+	}
+	for name, d := range fs.memFS.files {
+		if filepath.Dir(name) == dir {
+			fs.durableDir[name] = d
+		}
+	}
+
+	return nil
+}
+
+// recover returns the file system as it's found after the crash
+func (fs *faultFS) recover(mode crashMode) FS {
+	fs.memFS.mu.Lock()
+	defer fs.memFS.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	recovered := NewMemFS().(*memFS)
+
+	if mode == dropUnsynced {
+		for name, d := range fs.durableDir {
+			recovered.files[name] = &memData{data: append([]byte(nil), fs.durable[d]...)}
+		}
+		return recovered
+	}
+
+	for name, d := range fs.memFS.files {
+		data := append([]byte(nil), d.data...)
+
+		// only sectors before the tear of the last append made it to disk
+		w, ok := fs.lastWrite[d]
+		if ok && mode == tornWrite && w.append && w.off+w.n == int64(len(data)) {
+			tear := (w.off + w.n/2) / sectorSize * sectorSize
+			if tear < w.off {
+				tear = w.off
+			}
+			data = data[:tear]
+		}
+
+		recovered.files[name] = &memData{data: data}
+	}
+
+	return recovered
+}
+
+// dirtyPages returns the largest number of pages of a mapped file that
+// changed since it was synced
+func (fs *faultFS) dirtyPages() int {
+	fs.memFS.mu.Lock()
+	defer fs.memFS.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := 0
+	for d := range fs.mapped {
+		pages := len(dirtyPages(fs.durable[d], d.data))
+		if pages > n {
+			n = pages
+		}
+	}
+
+	return n
+}
+
+// dirtyPages returns offsets of pages of data that differ from durable
+func dirtyPages(durable, data []byte) []int {
+	var pages []int
+	for off := 0; off < len(data); off += pageSize {
+		end := off + pageSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		for i := off; i < end; i++ {
+			var b byte
+			if i < len(durable) {
+				b = durable[i]
+			}
+			if data[i] != b {
+				pages = append(pages, off)
+				break
+			}
+		}
+	}
+
+	return pages
+}
+
+// recoverPages returns the file system as it's found after the crash if
+// pages of mapped files are written back in any order: the i-th changed
+// page of every mapped file is kept if the i-th bit of keep is set, other
+// files keep everything
+func (fs *faultFS) recoverPages(keep uint64) FS {
+	fs.memFS.mu.Lock()
+	defer fs.memFS.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	recovered := NewMemFS().(*memFS)
+	for name, d := range fs.memFS.files {
+		data := append([]byte(nil), d.data...)
+
+		if fs.mapped[d] {
+			durable := fs.durable[d]
+			for i, off := range dirtyPages(durable, data) {
+				if i < 64 && keep&(1<<uint(i)) != 0 {
+					continue
+				}
+
+				// the page keeps its durable content
+				for j := off; j < off+pageSize && j < len(data); j++ {
+					data[j] = 0
+					if j < len(durable) {
+						data[j] = durable[j]
+					}
+				}
+			}
+		}
+
+		recovered.files[name] = &memData{data: data}
+	}
+
+	return recovered
+}
+
+// faultFile is a file of faultFS
+type faultFile struct {
+	File
+	fs *faultFS
+	d  *memData
+}
+
+func (f *faultFile) WriteAt(b []byte, off int64) (int, error) {
+	err := f.fs.op()
+	if err != nil {
+		return 0, err
+	}
+
+	f.d.mu.RLock()
+	size := int64(len(f.d.data))
+	f.d.mu.RUnlock()
+
+	n, err := f.File.WriteAt(b, off)
+
+	f.fs.mu.Lock()
+	f.fs.lastWrite[f.d] = write{off: off, n: int64(n), append: off+int64(n) > size}
+	f.fs.mu.Unlock()
+
+	return n, err
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	err := f.fs.op()
+	if err != nil {
+		return err
+	}
+
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	err := f.fs.op()
+	if err != nil {
+		return err
+	}
+
+	err = f.File.Sync()
+	if err != nil {
+		return err
+	}
+
+	f.fs.sync(f.d)
+	return nil
+}
+
+func (f *faultFile) Map(writable bool) (Mapping, error) {
+	m, err := f.File.Map(writable)
+	if err != nil {
+		return nil, err
+	}
+
+	f.fs.mu.Lock()
+	f.fs.mapped[f.d] = true
+	f.fs.mu.Unlock()
+
+	return &faultMapping{Mapping: m, f: f}, nil
+}
+
+// faultMapping makes the mapped file durable on flush
+type faultMapping struct {
+	Mapping
+	f *faultFile
+}
+
+func (m *faultMapping) Flush() error {
+	err := m.f.fs.op()
+	if err != nil {
+		return err
+	}
+
+	m.f.fs.sync(m.f.d)
+	return nil
+}
+
+// crashErr returns errCrash if the file system has crashed
+func (fs *faultFS) crashErr() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.crashed {
+		return errCrash
+	}
+
+	return nil
+}
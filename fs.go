@@ -0,0 +1,202 @@
+package wal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// FS is the file system a log is stored in, names are paths
+// in the form of filepath.Join(dir, name)
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	// ReadDir returns names of files in dir sorted by name
+	ReadDir(dir string) ([]string, error)
+	// SyncDir makes creations, renames and removals in dir durable
+	SyncDir(dir string) error
+	// Lock takes an exclusive lock of the file name, it returns ErrLocked
+	// if it's held, the lock is released when the closer is closed
+	Lock(name string) (io.Closer, error)
+	// SameFile reports whether fi1 and fi2 returned by Stat of FS or File
+	// describe the same file
+	SameFile(fi1, fi2 os.FileInfo) bool
+}
+
+// File is a file opened by FS
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	// Map maps the whole file into memory, writable maps could be
+	// changed and are written back to the file by Flush
+	Map(writable bool) (Mapping, error)
+}
+
+// Mapping is a file mapped into memory
+type Mapping interface {
+	Bytes() []byte
+	Flush() error
+	Unmap() error
+}
+
+// OSFS stores logs in the operating system file system
+// with indexes mapped by mmap, it's used by default
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return osFile{f}, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (osFS) SameFile(fi1, fi2 os.FileInfo) bool {
+	return os.SameFile(fi1, fi2)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lock(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return lockedFile{f}, nil
+}
+
+// lockedFile releases the lock when it's closed
+type lockedFile struct {
+	*os.File
+}
+
+func (f lockedFile) Close() error {
+	err := unlock(f.File)
+	if err != nil {
+		_ = f.File.Close()
+		return err
+	}
+
+	return f.File.Close()
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Map(writable bool) (Mapping, error) {
+	prot := mmap.RDONLY
+	if writable {
+		prot = mmap.RDWR
+	}
+
+	mm, err := mmap.Map(f.File, prot, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &osMapping{mm: mm}, nil
+}
+
+type osMapping struct {
+	mm mmap.MMap
+}
+
+func (m *osMapping) Bytes() []byte {
+	return m.mm
+}
+
+func (m *osMapping) Flush() error {
+	return m.mm.Flush()
+}
+
+func (m *osMapping) Unmap() error {
+	return m.mm.Unmap()
+}
+
+// readFile reads the whole file name from fs
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, st.Size())
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b[:n], nil
+}
+
+// createFile creates an empty file name in fs or truncates an existing one
+func createFile(fs FS, name string) error {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -4,4 +4,4 @@ go 1.18
 
 require github.com/edsrzf/mmap-go v1.1.0
 
-require golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+require golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("file is not a valid log file")
+
+// file header structure:
+// [magic (4 bytes)][kind (1 byte)][version (1 byte)][flags (2 bytes)]
+// [startID (8 bytes)][created (8 bytes)][reserved (4 bytes)][crc32c (4 bytes)]
+//
+// files written before headers were introduced are format version 0,
+// they start right with index entries or records, magic can't be confused
+// with them: its first byte would be an enormous record id or record size
+const (
+	headerSize    = 32
+	headerVersion = 1
+
+	indexKind = 'I'
+	storeKind = 'S'
+)
+
+var headerMagic = [4]byte{0x89, 'W', 'A', 'L'}
+
+// file flags
+const (
+	// flagCRC32C means records are protected with CRC32C checksums
+	flagCRC32C = 1 << iota
+)
+
+// fileHeader is stored at the beginning of index and store files
+type fileHeader struct {
+	kind    byte
+	version byte
+	flags   uint16
+	startID uint64
+	created time.Time
+}
+
+func newFileHeader(kind byte, startID uint64) fileHeader {
+	return fileHeader{
+		kind:    kind,
+		version: headerVersion,
+		flags:   flagCRC32C,
+		startID: startID,
+		created: time.Now(),
+	}
+}
+
+func (h fileHeader) marshal() []byte {
+	b := make([]byte, headerSize)
+	copy(b[0:4], headerMagic[:])
+	b[4] = h.kind
+	b[5] = h.version
+	binary.BigEndian.PutUint16(b[6:8], h.flags)
+	binary.BigEndian.PutUint64(b[8:16], h.startID)
+	binary.BigEndian.PutUint64(b[16:24], uint64(h.created.UnixNano()))
+	binary.BigEndian.PutUint32(b[28:32], crc32.Checksum(b[0:28], crcTable))
+
+	return b
+}
+
+// hasMagic reports whether b starts with a file header
+func hasMagic(b []byte) bool {
+	return len(b) >= len(headerMagic) && string(b[0:4]) == string(headerMagic[:])
+}
+
+// parseFileHeader decodes and validates a header of kind
+func parseFileHeader(b []byte, kind byte) (fileHeader, error) {
+	if len(b) < headerSize || !hasMagic(b) {
+		return fileHeader{}, ErrInvalidHeader
+	}
+
+	if crc32.Checksum(b[0:28], crcTable) != binary.BigEndian.Uint32(b[28:32]) {
+		return fileHeader{}, fmt.Errorf("%w: checksum mismatch", ErrInvalidHeader)
+	}
+
+	h := fileHeader{
+		kind:    b[4],
+		version: b[5],
+		flags:   binary.BigEndian.Uint16(b[6:8]),
+		startID: binary.BigEndian.Uint64(b[8:16]),
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(b[16:24]))),
+	}
+
+	if h.kind != kind {
+		return fileHeader{}, fmt.Errorf("%w: unexpected file kind %q", ErrInvalidHeader, h.kind)
+	}
+	if h.version == 0 || h.version > headerVersion {
+		return fileHeader{}, fmt.Errorf("%w: unsupported format version %d", ErrInvalidHeader, h.version)
+	}
+
+	return h, nil
+}
@@ -0,0 +1,112 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileHeader(t *testing.T) {
+	h := newFileHeader(storeKind, 42)
+	b := h.marshal()
+
+	if len(b) != headerSize || !hasMagic(b) {
+		t.Fatal("header should start with magic")
+	}
+
+	got, err := parseFileHeader(b, storeKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.startID != 42 || got.version != headerVersion || got.flags != flagCRC32C || !got.created.Equal(h.created) {
+		t.Errorf("wrong header: %+v", got)
+	}
+
+	_, err = parseFileHeader(b, indexKind)
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Error("store header is not an index header")
+	}
+
+	b[10]++
+	_, err = parseFileHeader(b, storeKind)
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Error("corrupted header should be rejected")
+	}
+}
+
+func TestOpenJunkFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, segmentName(1))
+	err = ioutil.WriteFile(name+".index", []byte("this is not an index"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name+".store", []byte("this is not a store"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(dir, nil)
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("should return ErrInvalidHeader, got %v", err)
+	}
+}
+
+func TestOpenHeaderlessFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-headerless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// segment written before headers were introduced
+	name := filepath.Join(dir, segmentName(1))
+	store := appendRecord(nil, []byte("first"), 0)
+	store = appendRecord(store, []byte("second"), 0)
+	index := make([]byte, 32)
+	binary.BigEndian.PutUint64(index[0:8], 1)
+	binary.BigEndian.PutUint64(index[16:24], 2)
+	binary.BigEndian.PutUint64(index[24:32], recordHeaderSize+5)
+
+	err = ioutil.WriteFile(name+".index", index, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name+".store", store, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	if wal.activeSegment.store.base != 0 || wal.activeSegment.idx.header.version != 0 {
+		t.Error("headerless segment should stay headerless")
+	}
+
+	for id, want := range map[uint64]string{1: "first", 2: "second"} {
+		data, err := wal.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Error("read is not right")
+		}
+	}
+
+	id, err := wal.Append([]byte("third"))
+	if err != nil || id != 3 {
+		t.Errorf("append should continue headerless segment: %d %v", id, err)
+	}
+}
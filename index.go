@@ -3,18 +3,31 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"os"
-
-	"github.com/edsrzf/mmap-go"
+	"sync/atomic"
 )
 
-var ErrMaxIndexSize = errors.New("max index size should be multiple by 16 and more than 0")
+var (
+	ErrMaxIndexSize = errors.New("max index size should be multiple by 16 and more than 0")
+	ErrCorruptIndex = errors.New("index is corrupted")
+)
 
 // index will store mapping between recordID and recordOffset
 // it will maintain it in memory and in index file
 type index struct {
-	mm      mmap.MMap
-	idxFile *os.File
+	// committed is the id after the last entry visible to readers,
+	// it's accessed atomically and kept first for 64-bit alignment
+	committed uint64
+
+	fs      FS
+	mapping Mapping
+	mm      []byte
+	// entries is the part of mm after the file header
+	entries []byte
+	header  fileHeader
+	idxFile File
 	maxSize uint64
 	size    uint64
 	id      uint64
@@ -28,75 +41,259 @@ func (i *index) write(offset uint64) (uint64, error) {
 		return 0, errNoIndexSpaceLeft
 	}
 
-	binary.BigEndian.PutUint64(i.mm[ii:ii+8], i.id)
-	binary.BigEndian.PutUint64(i.mm[ii+8:ii+16], offset)
+	binary.BigEndian.PutUint64(i.entries[ii:ii+8], i.id)
+	binary.BigEndian.PutUint64(i.entries[ii+8:ii+16], offset)
 
 	i.size += 16
 	i.id++
 
-	return i.id - 1, i.mm.Flush()
+	return i.id - 1, nil
+}
+
+// free returns the number of entries that could be written
+func (i *index) free() uint64 {
+	return (i.maxSize - i.size) / 16
+}
+
+// publish makes written entries visible to readers
+func (i *index) publish() {
+	atomic.StoreUint64(&i.committed, i.id)
+}
+
+// committedID returns the id after the last entry visible to readers
+func (i *index) committedID() uint64 {
+	return atomic.LoadUint64(&i.committed)
 }
 
+// read returns offset of a committed record, it could be called
+// concurrently with write
 func (i *index) read(id uint64) (uint64, error) {
-	ii := (id - i.startID) * 16
-	if id == 0 || ii >= i.size {
+	if id == 0 || id < i.startID || id >= i.committedID() {
 		return 0, ErrRecordNotFound
 	}
 
-	sID := binary.BigEndian.Uint64(i.mm[ii : ii+8])
-	sOffset := binary.BigEndian.Uint64(i.mm[ii+8 : ii+16])
+	ii := (id - i.startID) * 16
+	sID := binary.BigEndian.Uint64(i.entries[ii : ii+8])
+	sOffset := binary.BigEndian.Uint64(i.entries[ii+8 : ii+16])
 
 	if sID != id {
-		panic("write or read is not working correctly")
+		// entry was truncated after the check above
+		if id >= i.committedID() {
+			return 0, ErrRecordNotFound
+		}
+
+		return 0, fmt.Errorf("%s: %w: entry of record %d holds id %d", i.idxFile.Name(), ErrCorruptIndex, id, sID)
 	}
 
 	return sOffset, nil
 }
 
+// sync commits written entries to disk
+func (i *index) sync() error {
+	return i.mapping.Flush()
+}
+
+// truncate removes all entries starting with id
+func (i *index) truncate(id uint64) error {
+	if id < i.startID || id > i.id {
+		return ErrRecordNotFound
+	}
+
+	ii := (id - i.startID) * 16
+	for j := ii; j < i.size; j++ {
+		i.entries[j] = 0
+	}
+
+	i.size = ii
+	i.id = id
+	i.publish()
+
+	return i.mapping.Flush()
+}
+
 func (i *index) close() error {
+	err := i.mapping.Unmap()
+	if err != nil {
+		return err
+	}
+	i.mm = nil
+	i.entries = nil
+
 	return i.idxFile.Close()
 }
 
 func (i *index) remove() error {
-	return os.Remove(i.idxFile.Name())
+	return i.fs.Remove(i.idxFile.Name())
 }
 
 func newIndex(file string, cfg *Config, startID uint64) (*index, error) {
 	if startID == 0 {
-		panic("recordID should not be zero")
+		return nil, fmt.Errorf("%s: %w: start id is zero", file, ErrCorruptIndex)
+	}
+
+	if cfg.readOnly {
+		return openIndexReadOnly(cfg.fs(), file, startID)
 	}
 
 	if cfg.Segment.MaxIndexSizeBytes == 0 || cfg.Segment.MaxIndexSizeBytes%16 != 0 {
 		return nil, ErrMaxIndexSize
 	}
 
-	_, err := os.Stat(file)
+	f, err := cfg.fs().OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	header, base, err := readIndexHeader(f, startID)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	// index is never shrunk below its entries, so an index written with
+	// a larger size keeps them and is full after that
+	maxSize, err := indexSize(f, base, cfg.Segment.MaxIndexSizeBytes)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	err = f.Truncate(int64(base + maxSize))
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	mapping, err := f.Map(true)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	// new index, header is persisted right away
+	mm := mapping.Bytes()
+	if base > 0 && !hasMagic(mm) {
+		copy(mm, header.marshal())
+		err = mapping.Flush()
+		if err != nil {
+			_ = mapping.Unmap()
+			_ = f.Close()
+			return nil, err
+		}
+	}
+
+	return loadIndex(cfg.fs(), f, mapping, header, base, maxSize, startID), nil
+}
+
+// checkEnd reports entries after the end of a sealed index as corrupted,
+// only the slot right after the end could hold a torn entry
+func (i *index) checkEnd() error {
+	base := uint64(len(i.mm) - len(i.entries))
+	for j := i.size + 16; j < i.maxSize; j++ {
+		if i.entries[j] != 0 {
+			return fmt.Errorf("%s: %w: data after the last entry at %d", i.idxFile.Name(), ErrCorruptIndex, base+j)
+		}
+	}
+
+	return nil
+}
+
+// clearEnd zeroes slots after the end of the index, pages of the mapped
+// index are written back in any order, so entries after a lost page could
+// be on disk while the page is not
+func (i *index) clearEnd() error {
+	cleared := false
+	for j := i.size; j < i.maxSize; j++ {
+		if i.entries[j] != 0 {
+			i.entries[j] = 0
+			cleared = true
+		}
+	}
+	if !cleared {
+		return nil
+	}
+
+	return i.mapping.Flush()
+}
+
+// indexSize returns the size of index entries, it's maxSize unless the
+// file holds non-zero entries after it, then it's the end of the last one
+func indexSize(f File, base, maxSize uint64) (uint64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(st.Size())
+	if size <= base+maxSize {
+		return maxSize, nil
+	}
+
+	b := make([]byte, size-base-maxSize)
+	_, err = f.ReadAt(b, int64(base+maxSize))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0 {
+			return (maxSize + uint64(i) + 16) / 16 * 16, nil
+		}
+	}
+
+	return maxSize, nil
+}
+
+// openIndexReadOnly maps an existing index for reading, the file is
+// mapped as it is, the writer has already sized it
+func openIndexReadOnly(fs FS, file string, startID uint64) (*index, error) {
+	f, err := fs.OpenFile(file, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.OpenFile(file, os.O_RDWR, 0644)
+	st, err := f.Stat()
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
+	if st.Size() == 0 {
+		_ = f.Close()
+		return nil, errSegmentNotReady
+	}
 
-	err = os.Truncate(f.Name(), int64(cfg.Segment.MaxIndexSizeBytes))
+	header, base, err := readIndexHeader(f, startID)
+	if err == nil && uint64(st.Size()) < base {
+		err = errSegmentNotReady
+	}
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
 
-	mm, err := mmap.Map(f, mmap.RDWR, 0)
+	mapping, err := f.Map(false)
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
 
+	maxSize := (uint64(st.Size()) - base) / 16 * 16
+
+	return loadIndex(fs, f, mapping, header, base, maxSize, startID), nil
+}
+
+// loadIndex finds the end of the mapped index, entries are written
+// sequentially, the first slot that doesn't hold the next expected id
+// is the end of the index
+func loadIndex(fs FS, f File, mapping Mapping, header fileHeader, base, maxSize, startID uint64) *index {
+	mm := mapping.Bytes()
+	entries := mm[base:]
 	var size uint64
 	id := startID
-	for i := 0; i < len(mm); i += 16 {
-		b1 := binary.BigEndian.Uint64(mm[i : i+8])
-		b2 := binary.BigEndian.Uint64(mm[i+8 : i+16])
+	for i := uint64(0); i+16 <= maxSize; i += 16 {
+		b1 := binary.BigEndian.Uint64(entries[i : i+8])
 
-		if b1 == 0 && b2 == 0 {
+		if b1 != id {
 			break
 		}
 
@@ -104,14 +301,54 @@ func newIndex(file string, cfg *Config, startID uint64) (*index, error) {
 		id++
 	}
 
-	idx := &index{
-		mm:      mm,
-		idxFile: f,
-		maxSize: cfg.Segment.MaxIndexSizeBytes,
-		size:    size,
-		id:      id,
-		startID: startID,
+	return &index{
+		committed: id,
+		fs:        fs,
+		mapping:   mapping,
+		mm:        mm,
+		entries:   entries,
+		header:    header,
+		idxFile:   f,
+		maxSize:   maxSize,
+		size:      size,
+		id:        id,
+		startID:   startID,
+	}
+}
+
+// readIndexHeader returns index header and its size, empty files get
+// a new header, files without header are accepted if they look like
+// an index of a segment that starts with startID
+func readIndexHeader(f File, startID uint64) (fileHeader, uint64, error) {
+	b := make([]byte, headerSize)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, 0, err
+	}
+
+	if n == 0 {
+		return newFileHeader(indexKind, startID), headerSize, nil
+	}
+
+	if hasMagic(b[:n]) {
+		h, err := parseFileHeader(b[:n], indexKind)
+		if err != nil {
+			return fileHeader{}, 0, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if h.startID != startID {
+			return fileHeader{}, 0, fmt.Errorf("%s: %w: start id %d, expected %d", f.Name(), ErrInvalidHeader, h.startID, startID)
+		}
+
+		return h, headerSize, nil
+	}
+
+	// legacy index, the first entry is either empty or holds startID
+	if n >= 8 {
+		first := binary.BigEndian.Uint64(b[0:8])
+		if first != 0 && first != startID {
+			return fileHeader{}, 0, fmt.Errorf("%s: %w", f.Name(), ErrInvalidHeader)
+		}
 	}
 
-	return idx, nil
+	return fileHeader{startID: startID}, 0, nil
 }
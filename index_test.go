@@ -63,6 +63,7 @@ func TestIndexReadWrite(t *testing.T) {
 
 		ids = append(ids, id)
 	}
+	i1.publish()
 
 	for i, id := range ids {
 		offset, err := i1.read(id)
@@ -111,3 +112,92 @@ func TestMaxIndexSize(t *testing.T) {
 		t.Error("should be ErrMaxIndexSize 11 is not multiple of 16")
 	}
 }
+
+func TestIndexCorrupted(t *testing.T) {
+	f, err := ioutil.TempFile("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = newIndex(f.Name(), &defaultConfig, 0)
+	if !errors.Is(err, ErrCorruptIndex) {
+		t.Errorf("zero start id should return ErrCorruptIndex, got %v", err)
+	}
+
+	i, err := newIndex(f.Name(), &defaultConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.close()
+
+	for _, offset := range []uint64{0, 10} {
+		_, err := i.write(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	i.publish()
+
+	// the file is changed under the mapped index
+	_, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 0, 7}, headerSize+16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = i.read(2)
+	if !errors.Is(err, ErrCorruptIndex) {
+		t.Errorf("should return ErrCorruptIndex, got %v", err)
+	}
+}
+
+func TestIndexShrink(t *testing.T) {
+	f, err := ioutil.TempFile("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	cfg := &Config{}
+	cfg.Segment.MaxIndexSizeBytes = 16 * 8
+
+	i, err := newIndex(f.Name(), cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := uint64(0); j < 5; j++ {
+		_, err := i.write(j * 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = i.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entries that don't fit into the smaller size are kept
+	cfg.Segment.MaxIndexSizeBytes = 16 * 2
+	i, err = newIndex(f.Name(), cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.id != 6 || i.maxSize != 16*5 || i.free() != 0 {
+		t.Errorf("index should keep its entries, next id %d, max size %d", i.id, i.maxSize)
+	}
+	err = i.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// empty space after the entries is dropped
+	cfg.Segment.MaxIndexSizeBytes = 16 * 6
+	i, err = newIndex(f.Name(), cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.close()
+	if i.id != 6 || i.maxSize != 16*6 {
+		t.Errorf("index should be resized, next id %d, max size %d", i.id, i.maxSize)
+	}
+}
@@ -0,0 +1,218 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+const iteratorBufferSize = 64 << 10
+
+// Iterator reads records sequentially starting from some id, it crosses
+// segment boundaries and reads store files with buffered reads, it's not
+// safe for concurrent use. Iterator holds a reference to the segment it
+// reads, so Close should be called when it's not needed anymore
+type Iterator struct {
+	w      *WAL
+	seg    *segment
+	reader *bufio.Reader
+	// limit is the number of bytes left in the reader
+	limit uint64
+	// next is the id of the next record, end is the id after
+	// the last record that was in the segment when it was opened
+	next uint64
+	end  uint64
+	id   uint64
+	data []byte
+	err  error
+}
+
+// NewIterator returns an iterator positioned before fromID, fromID could
+// be the id right after the last record to read records appended later
+func (w *WAL) NewIterator(fromID uint64) (*Iterator, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if fromID == 0 || fromID < w.firstID() || fromID > w.activeSegment.idx.committedID() {
+		return nil, ErrRecordNotFound
+	}
+
+	return &Iterator{w: w, next: fromID}, nil
+}
+
+// Next advances the iterator to the next record, it returns false
+// when there are no more records or an error occurred, Next could
+// be called again to pick up records appended after that
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for it.reader == nil || it.next >= it.end {
+		ok, err := it.open()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	data, h, err := readFrom(it.reader, it.limit)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrCorruptRecord
+		}
+		it.err = err
+		return false
+	}
+
+	it.limit -= h.frameSize()
+
+	data, err = it.w.decode(data, h.flags)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.id = it.next
+	it.data = data
+	it.next++
+
+	return true
+}
+
+// open positions the reader at the next record, it returns false
+// if the next record is not appended yet
+func (it *Iterator) open() (bool, error) {
+	it.w.mu.RLock()
+	defer it.w.mu.RUnlock()
+
+	if it.w.closed {
+		return false, ErrClosed
+	}
+	if it.next < it.w.firstID() {
+		return false, ErrRecordNotFound
+	}
+
+	for _, s := range it.w.segments {
+		end := s.idx.committedID()
+		if it.next < s.idx.startID || it.next >= end {
+			continue
+		}
+
+		offset, err := s.idx.read(it.next)
+		if err != nil {
+			return false, err
+		}
+
+		if s != it.seg {
+			s.acquire()
+			it.release()
+			it.seg = s
+		}
+
+		it.limit = atomic.LoadUint64(&s.store.size) - offset
+		it.reader = bufio.NewReaderSize(io.NewSectionReader(s.store.file, int64(offset), int64(it.limit)), iteratorBufferSize)
+		it.end = end
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// release drops the reference to the current segment
+func (it *Iterator) release() {
+	if it.seg != nil {
+		_ = it.seg.release()
+		it.seg = nil
+	}
+}
+
+// Close releases the segment held by the iterator
+func (it *Iterator) Close() error {
+	it.release()
+	it.reader = nil
+	return nil
+}
+
+// Record returns id and data of the current record
+func (it *Iterator) Record() (uint64, []byte) {
+	return it.id, it.data
+}
+
+// Err returns the error that stopped the iterator
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Follower is an iterator that waits for new records when it reaches
+// the end of the log, it keeps reading across segment rotation
+type Follower struct {
+	it  *Iterator
+	err error
+}
+
+// Follow returns a follower positioned before fromID
+func (w *WAL) Follow(fromID uint64) (*Follower, error) {
+	it, err := w.NewIterator(fromID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Follower{it: it}, nil
+}
+
+// Next advances the follower to the next record, it blocks until
+// the record is appended, it returns false when ctx is done, the log
+// is closed or an error occurred, Err returns ErrClosed in the second case
+func (f *Follower) Next(ctx context.Context) bool {
+	if f.err != nil {
+		return false
+	}
+
+	for {
+		// take the channel before reading so an append
+		// between the read and the wait is not missed
+		appended := f.it.w.appendedChan()
+
+		if f.it.Next() {
+			return true
+		}
+		if f.it.Err() != nil {
+			f.err = f.it.Err()
+			return false
+		}
+
+		select {
+		case <-appended:
+		case <-f.it.w.done:
+			f.err = ErrClosed
+			return false
+		case <-ctx.Done():
+			f.err = ctx.Err()
+			return false
+		}
+	}
+}
+
+// Record returns id and data of the current record
+func (f *Follower) Record() (uint64, []byte) {
+	return f.it.Record()
+}
+
+// Err returns the error that stopped the follower
+func (f *Follower) Err() error {
+	return f.err
+}
+
+// Close releases the segment held by the follower
+func (f *Follower) Close() error {
+	return f.it.Close()
+}
@@ -0,0 +1,204 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-iterator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 48
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("record-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, from := range []uint64{1, 3, 4, 10} {
+		it, err := wal.NewIterator(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := from
+		for it.Next() {
+			id, data := it.Record()
+			if id != want {
+				t.Errorf("id should be %d, got %d", want, id)
+			}
+			if string(data) != fmt.Sprintf("record-%d", id) {
+				t.Error("read is not right")
+			}
+			want++
+		}
+		if it.Err() != nil {
+			t.Error(it.Err())
+		}
+		if want != 11 {
+			t.Errorf("iterator from %d stopped at %d", from, want)
+		}
+	}
+
+	// exhausted iterator picks up new records
+	it, err := wal.NewIterator(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() {
+		t.Error("there are no records yet")
+	}
+
+	_, err = wal.Append([]byte("record-11"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !it.Next() {
+		t.Fatal("should read appended record")
+	}
+	if id, data := it.Record(); id != 11 || string(data) != "record-11" {
+		t.Error("read is not right")
+	}
+
+	_, err = wal.NewIterator(13)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Error("should not iterate from the future")
+	}
+	_, err = wal.NewIterator(0)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Error("should not iterate from zero")
+	}
+}
+
+func TestIteratorCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-iterator-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []string{"first", "second"} {
+		_, err := wal.Append([]byte(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offset, _ := wal.activeSegment.idx.read(2)
+	f, err := os.OpenFile(wal.activeSegment.store.file.Name(), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte{'x'}, int64(offset+recordHeaderSize))
+	_ = f.Close()
+
+	it, err := wal.NewIterator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !it.Next() {
+		t.Fatal("first record is fine")
+	}
+	if it.Next() {
+		t.Error("second record is corrupted")
+	}
+	if !errors.Is(it.Err(), ErrCorruptRecord) {
+		t.Errorf("should return ErrCorruptRecord, got %v", it.Err())
+	}
+}
+
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const records = 10
+	for i := 1; i <= 6; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("record-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := wal.Follow(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 7; i <= records; i++ {
+			time.Sleep(time.Millisecond)
+			_, err := wal.Append([]byte(fmt.Sprintf("record-%d", i)))
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for want := uint64(3); want <= records; want++ {
+		if !f.Next(ctx) {
+			t.Fatalf("follower stopped: %v", f.Err())
+		}
+		id, data := f.Record()
+		if id != want || string(data) != fmt.Sprintf("record-%d", want) {
+			t.Errorf("read is not right: %d %s", id, data)
+		}
+
+		if id == 3 {
+			// remove the segment follower is reading
+			err = wal.Trim(5)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if f.Next(ctx) {
+		t.Error("there are no more records")
+	}
+	if !errors.Is(f.Err(), context.DeadlineExceeded) {
+		t.Errorf("should stop with context error, got %v", f.Err())
+	}
+}
@@ -0,0 +1,18 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+const lockFile = "LOCK"
+
+var ErrLocked = errors.New("log is locked by another process")
+
+// lockDir takes an exclusive lock of dir, it prevents two processes or
+// two New calls from appending to the same log, it returns ErrLocked
+// if the lock is held
+func lockDir(fs FS, dir string) (io.Closer, error) {
+	return fs.Lock(filepath.Join(dir, lockFile))
+}
@@ -0,0 +1,41 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(dir, nil)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("second open should return ErrLocked, got %v", err)
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = New(dir, nil)
+	if err != nil {
+		t.Fatalf("log should be opened after close: %v", err)
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,346 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memFS is a file system that keeps files in memory, files that are
+// removed stay readable through files that are still open
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	locks map[string]bool
+}
+
+// NewMemFS returns an empty in-memory file system, logs stored in it
+// are lost when it's not referenced anymore, syncs are no-ops
+func NewMemFS() FS {
+	return &memFS{
+		files: make(map[string]*memData),
+		locks: make(map[string]bool),
+	}
+}
+
+// memData is the content of a file
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		fs.files[name] = d
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+
+	return &memFile{name: name, d: d, writable: writable}, nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	d, ok := fs.files[name]
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return d.stat(name), nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+
+	return nil
+}
+
+func (fs *memFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = d
+
+	return nil
+}
+
+func (fs *memFS) ReadDir(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (fs *memFS) SyncDir(dir string) error {
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file, files
+// share their data even if they are renamed
+func (fs *memFS) SameFile(fi1, fi2 os.FileInfo) bool {
+	d1, ok1 := fi1.Sys().(*memData)
+	d2, ok2 := fi2.Sys().(*memData)
+
+	return ok1 && ok2 && d1 == d2
+}
+
+func (fs *memFS) Lock(name string) (io.Closer, error) {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+	fs.locks[name] = true
+
+	return &memLock{fs: fs, name: name}, nil
+}
+
+type memLock struct {
+	fs   *memFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(d.data)), modTime: d.modTime, d: d}
+}
+
+// memFile is an open file of memFS
+type memFile struct {
+	name     string
+	d        *memData
+	writable bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && !f.writable {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+
+	return nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	err := f.check("read", false)
+	if err != nil {
+		return 0, err
+	}
+
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.d.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	err := f.check("write", true)
+	if err != nil {
+		return 0, err
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	end := off + int64(len(b))
+	if end > int64(len(f.d.data)) {
+		f.d.grow(end)
+	}
+	copy(f.d.data[off:], b)
+	f.d.modTime = time.Now()
+
+	return len(b), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	err := f.check("truncate", true)
+	if err != nil {
+		return err
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if size > int64(len(f.d.data)) {
+		f.d.grow(size)
+	} else {
+		// cut bytes are zeroed so growing the file again exposes zeros
+		for i := size; i < int64(len(f.d.data)); i++ {
+			f.d.data[i] = 0
+		}
+		f.d.data = f.d.data[:size]
+	}
+	f.d.modTime = time.Now()
+
+	return nil
+}
+
+// grow extends data to size, it should be called with mu held
+func (d *memData) grow(size int64) {
+	if size <= int64(cap(d.data)) {
+		d.data = d.data[:size]
+		return
+	}
+
+	data := make([]byte, size, size*2)
+	copy(data, d.data)
+	d.data = data
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	err := f.check("stat", false)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.d.stat(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", false)
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+
+	return nil
+}
+
+// Map returns the file data itself, the mapping sees writes made within
+// the current size of the file like a shared memory mapping does
+func (f *memFile) Map(writable bool) (Mapping, error) {
+	err := f.check("mmap", writable)
+	if err != nil {
+		return nil, err
+	}
+
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	return &memMapping{b: f.d.data[:len(f.d.data):len(f.d.data)]}, nil
+}
+
+type memMapping struct {
+	b []byte
+}
+
+func (m *memMapping) Bytes() []byte {
+	return m.b
+}
+
+func (m *memMapping) Flush() error {
+	return nil
+}
+
+func (m *memMapping) Unmap() error {
+	m.b = nil
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	d       *memData
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return fi.d }
@@ -0,0 +1,178 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	_, err := fs.OpenFile("/dir/file", os.O_RDWR, 0644)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("should return os.ErrNotExist, got %v", err)
+	}
+
+	f, err := fs.OpenFile("/dir/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("0123456789"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := f.Map(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(m.Bytes(), "abc")
+	_, err = f.WriteAt([]byte("xyz"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Bytes()) != "abc3456xyz" {
+		t.Errorf("mapping should share data with the file, got %q", m.Bytes())
+	}
+
+	err = f.Truncate(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	n, err := f.ReadAt(b, 0)
+	if err != io.EOF || !bytes.Equal(b[:n], []byte("abc3\x00\x00")) {
+		t.Errorf("truncated bytes should be zeroed, got %q, %v", b[:n], err)
+	}
+
+	// removed file stays readable through open files
+	err = fs.Rename("/dir/file", "/dir/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := fs.ReadDir("/dir")
+	if err != nil || len(names) != 1 || names[0] != "renamed" {
+		t.Errorf("unexpected files %v, %v", names, err)
+	}
+	err = fs.Remove("/dir/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ReadAt(b[:4], 0)
+	if err != nil || string(b[:4]) != "abc3" {
+		t.Errorf("removed file should be readable, got %q, %v", b[:4], err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Stat()
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("should return os.ErrClosed, got %v", err)
+	}
+
+	l, err := fs.Lock("/dir/LOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Lock("/dir/LOCK")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("should return ErrLocked, got %v", err)
+	}
+	_ = l.Close()
+	l, err = fs.Lock("/dir/LOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+}
+
+func TestWALMemFS(t *testing.T) {
+	// the directory doesn't exist on disk
+	dir := filepath.Join(os.TempDir(), "wal-mem-fs-does-not-exist")
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	cfg.FS = NewMemFS()
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(dir, &cfg)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("should return ErrLocked, got %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = wal.AppendBatch([][]byte{[]byte("record 6"), []byte("record 7")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.TruncateBefore(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReadOnly(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(dir)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("log should not touch disk")
+	}
+
+	report, err := VerifyFS(cfg.FS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.FirstID != 2 || report.LastID != 7 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for _, w := range []*WAL{wal, r} {
+		if w.FirstID() != 2 || w.LastID() != 7 || w.SegmentCount() != 4 {
+			t.Errorf("expected ids 2..7 in 4 segments, got %d..%d in %d", w.FirstID(), w.LastID(), w.SegmentCount())
+		}
+		for id := uint64(2); id <= 7; id++ {
+			data, err := w.Read(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != fmt.Sprintf("record %d", id) {
+				t.Errorf("record %d: got %q", id, data)
+			}
+		}
+	}
+}
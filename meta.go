@@ -0,0 +1,71 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const metaFile = "META"
+
+var ErrCorruptMeta = errors.New("meta file is corrupted")
+
+// meta holds log state that can't be derived from segments
+// meta file structure: [firstID (8 bytes)][crc32c (4 bytes)]
+type meta struct {
+	// firstID is the low-water mark set by TruncateBefore,
+	// records before it are not visible even if they are in a segment
+	firstID uint64
+}
+
+// readMeta reads meta file from dir, missing file means empty meta
+func readMeta(fs FS, dir string) (meta, error) {
+	b, err := readFile(fs, filepath.Join(dir, metaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta{}, nil
+	}
+	if err != nil {
+		return meta{}, err
+	}
+
+	if len(b) != 12 || crc32.Checksum(b[0:8], crcTable) != binary.BigEndian.Uint32(b[8:12]) {
+		return meta{}, ErrCorruptMeta
+	}
+
+	return meta{firstID: binary.BigEndian.Uint64(b[0:8])}, nil
+}
+
+// writeMeta atomically replaces meta file in dir, it's written to
+// a temporary file first and renamed after it's synced
+func writeMeta(fs FS, dir string, m meta) error {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b[0:8], m.firstID)
+	binary.BigEndian.PutUint32(b[8:12], crc32.Checksum(b[0:8], crcTable))
+
+	tmp := filepath.Join(dir, metaFile+".tmp")
+	f, err := fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(b, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write meta: %w", err)
+	}
+
+	err = fs.Rename(tmp, filepath.Join(dir, metaFile))
+	if err != nil {
+		return err
+	}
+
+	return fs.SyncDir(dir)
+}
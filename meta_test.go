@@ -0,0 +1,48 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := readMeta(OSFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.firstID != 0 {
+		t.Error("missing meta should be empty")
+	}
+
+	err = writeMeta(OSFS, dir, meta{firstID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = readMeta(OSFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.firstID != 42 {
+		t.Errorf("firstID should be 42, got %d", m.firstID)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, metaFile), []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readMeta(OSFS, dir)
+	if !errors.Is(err, ErrCorruptMeta) {
+		t.Error("should return ErrCorruptMeta")
+	}
+}
@@ -0,0 +1,128 @@
+package wal
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var (
+	ErrReadOnly = errors.New("log is opened read-only")
+	// errSegmentNotReady is returned for a segment that is being
+	// created by the writer and has no headers yet
+	errSegmentNotReady = errors.New("segment is not initialized yet")
+)
+
+// OpenReadOnly opens the log in dir for reading, only Compression,
+// Encryption and FS of cfg are used, cfg could be nil. Files are never created,
+// truncated or written and the directory is not locked, so the log could be
+// read while another process appends to it. Append, Trim and truncation
+// return ErrReadOnly, Refresh picks up changes made by the writer. The tail
+// of the log is not recovered, records that the writer is appending could
+// be seen before the whole batch is written
+func OpenReadOnly(dir string, cfg *Config) (*WAL, error) {
+	roCfg := defaultConfig
+	if cfg != nil {
+		roCfg.Compression = cfg.Compression
+		roCfg.Encryption = cfg.Encryption
+		roCfg.FS = cfg.FS
+	}
+	roCfg.readOnly = true
+
+	return open(dir, &roCfg)
+}
+
+// Refresh picks up records appended by the writer and segments that were
+// created or removed since the log was opened, it wakes up followers if
+// there are new records. Refresh is a no-op for logs opened with New
+func (w *WAL) Refresh() error {
+	if !w.config.readOnly {
+		return nil
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	files, err := listSegments(w.config.FS, w.dir)
+	if err != nil {
+		return err
+	}
+
+	m, err := readMeta(w.config.FS, w.dir)
+	if err != nil {
+		return err
+	}
+
+	// the active segment is always reopened, its index is scanned again
+	// to find records appended since it was opened
+	sealed := w.segments[:len(w.segments)-1]
+	segments, err := openSegments(w.dir, files, w.config, sealed)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return ErrRecordNotFound
+	}
+
+	w.mu.Lock()
+	old := w.segments
+	lastID := w.activeSegment.idx.committedID()
+	w.segments = segments
+	w.activeSegment = segments[len(segments)-1]
+	w.lowWater = m.firstID
+	if w.activeSegment.idx.committedID() != lastID {
+		close(w.appended)
+		w.appended = make(chan struct{})
+	}
+	w.mu.Unlock()
+
+	// segments that are not reused are closed once readers are done
+	for _, s := range old {
+		if !containsSegment(segments, s) {
+			_ = s.release()
+		}
+	}
+
+	return nil
+}
+
+// findUnchanged returns a segment named name from segments if its store
+// is still in the directory and has the same size as when it was opened
+func findUnchanged(segments []*segment, name string) *segment {
+	for _, s := range segments {
+		if s.segmentID != name {
+			continue
+		}
+
+		opened, err := s.store.file.Stat()
+		if err != nil {
+			return nil
+		}
+		current, err := s.store.fs.Stat(s.store.file.Name())
+		if err != nil {
+			return nil
+		}
+
+		size := atomic.LoadUint64(&s.store.size)
+		if !s.store.fs.SameFile(opened, current) || uint64(current.Size()) != size {
+			return nil
+		}
+
+		return s
+	}
+
+	return nil
+}
+
+func containsSegment(segments []*segment, s *segment) bool {
+	for _, seg := range segments {
+		if seg == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,262 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-read-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = OpenReadOnly(dir, nil)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("empty directory should not be opened, got %v", err)
+	}
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	w, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := w.Append([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReadOnly(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	after, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != len(after) {
+		t.Fatalf("read-only open should not create files")
+	}
+	for i := range before {
+		if before[i].Name() != after[i].Name() || before[i].Size() != after[i].Size() {
+			t.Errorf("read-only open should not change %s", before[i].Name())
+		}
+	}
+
+	if r.FirstID() != 1 || r.LastID() != 3 {
+		t.Errorf("expected ids 1..3, got %d..%d", r.FirstID(), r.LastID())
+	}
+
+	_, err = r.Append([]byte("data"))
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("append should return ErrReadOnly, got %v", err)
+	}
+	_, _, err = r.AppendBatch([][]byte{[]byte("data")})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("append batch should return ErrReadOnly, got %v", err)
+	}
+	err = r.Trim(2)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("trim should return ErrReadOnly, got %v", err)
+	}
+	err = r.TruncateBefore(2)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("truncate before should return ErrReadOnly, got %v", err)
+	}
+	err = r.TruncateAfter(2)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("truncate after should return ErrReadOnly, got %v", err)
+	}
+
+	f, err := r.Follow(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// writer rolls segments, the reader sees new records after refresh
+	for i := 3; i < 8; i++ {
+		_, err := w.Append([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = r.Read(4)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("record should not be visible before refresh, got %v", err)
+	}
+
+	err = r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LastID() != 8 || r.SegmentCount() != w.SegmentCount() {
+		t.Errorf("expected last id 8 and %d segments, got %d and %d", w.SegmentCount(), r.LastID(), r.SegmentCount())
+	}
+	for id := uint64(1); id <= 8; id++ {
+		data, err := r.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte{byte(id - 1)}) {
+			t.Errorf("record %d: got %v", id, data)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !f.Next(ctx) {
+		t.Fatal(f.Err())
+	}
+	if id, _ := f.Record(); id != 4 {
+		t.Errorf("follower should get record 4, got %d", id)
+	}
+
+	// segments removed by the writer go away after refresh
+	err = w.TruncateBefore(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FirstID() != 6 || r.SegmentCount() != w.SegmentCount() {
+		t.Errorf("expected first id 6 and %d segments, got %d and %d", w.SegmentCount(), r.FirstID(), r.SegmentCount())
+	}
+	_, err = r.Read(5)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("truncated record should not be found, got %v", err)
+	}
+
+	// records removed and appended again are picked up too
+	err = w.TruncateAfter(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Append([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := r.Read(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" || r.LastID() != 7 {
+		t.Errorf("expected new record 7, got %q and last id %d", data, r.LastID())
+	}
+}
+
+// opaqueFS is a file system that doesn't expose its files in Sys
+// of file infos, only the file system itself tells them apart
+type opaqueFS struct {
+	FS
+}
+
+type opaqueInfo struct {
+	os.FileInfo
+}
+
+func (opaqueInfo) Sys() interface{} {
+	return nil
+}
+
+type opaqueFile struct {
+	File
+}
+
+func (f opaqueFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return opaqueInfo{fi}, nil
+}
+
+func (fs opaqueFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return opaqueFile{f}, nil
+}
+
+func (fs opaqueFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.FS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return opaqueInfo{fi}, nil
+}
+
+func (fs opaqueFS) SameFile(fi1, fi2 os.FileInfo) bool {
+	return fs.FS.SameFile(fi1.(opaqueInfo).FileInfo, fi2.(opaqueInfo).FileInfo)
+}
+
+func TestRefreshKeepsSegments(t *testing.T) {
+	cfg := Config{FS: opaqueFS{NewMemFS()}}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	w, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := w.Append([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := OpenReadOnly("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	segments := append([]*segment(nil), r.segments...)
+
+	err = r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.segments) != len(segments) {
+		t.Fatalf("expected %d segments, got %d", len(segments), len(r.segments))
+	}
+	// the active segment is always reopened
+	for i, s := range segments[:len(segments)-1] {
+		if r.segments[i] != s {
+			t.Errorf("sealed segment %s should not be opened again", s.segmentID)
+		}
+	}
+}
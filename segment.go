@@ -1,42 +1,322 @@
 package wal
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 type segment struct {
 	idx       *index
 	store     *store
 	segmentID string
+	// refs is the number of references that keep segment files open,
+	// the log holds one and readers take more while they read
+	refs int32
 }
 
+// acquire takes a reference to the segment
+func (s *segment) acquire() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+// release drops a reference, segment is closed with the last one
+func (s *segment) release() error {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		return s.close()
+	}
+
+	return nil
+}
+
+// read returns data of a committed record
 func (s *segment) read(id uint64) ([]byte, error) {
-	offset, err := s.idx.read(id)
+	data, _, err := s.readRecord(id)
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := s.store.read(offset)
+	return data, nil
+}
+
+// readRecord returns a committed record with its header, it could be
+// called concurrently with writes to the segment
+func (s *segment) readRecord(id uint64) ([]byte, recordHeader, error) {
+	offset, err := s.idx.read(id)
 	if err != nil {
-		return nil, err
+		return nil, recordHeader{}, err
 	}
 
-	return data, nil
+	data, h, err := s.store.readRecord(offset)
+	if err != nil {
+		// record was truncated while it was read
+		if id >= s.idx.committedID() {
+			return nil, recordHeader{}, ErrRecordNotFound
+		}
+		return nil, recordHeader{}, err
+	}
+
+	return data, h, nil
 }
 
+// write writes a single record and makes it visible to readers
 func (s *segment) write(data []byte) (uint64, error) {
-	offset, err := s.store.write(data)
+	id, _, err := s.writeBatch([]entry{{data: data}})
+	if err != nil {
+		return 0, err
+	}
+	s.idx.publish()
+
+	return id, nil
+}
+
+// writeBatch writes as many records as fits into the segment, it returns
+// id of the first record and number of written records, records are not
+// visible to readers until the index is published
+func (s *segment) writeBatch(entries []entry) (uint64, int, error) {
+	free := s.idx.free()
+	if free == 0 {
+		return 0, 0, errNoIndexSpaceLeft
+	}
+	if uint64(len(entries)) > free {
+		entries = entries[:free]
+	}
+
+	offsets, err := s.store.writeBatch(entries)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	firstID := s.idx.id
+	for _, offset := range offsets {
+		_, err := s.idx.write(offset)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return firstID, len(offsets), nil
+}
+
+// empty reports whether segment has no records
+func (s *segment) empty() bool {
+	return s.idx.id == s.idx.startID
+}
+
+// sync flushes the store first so index never points at data
+// that is not on disk
+func (s *segment) sync() error {
+	err := s.store.sync()
+	if err != nil {
+		return err
+	}
+
+	return s.idx.sync()
+}
+
+// recover checks the tail of the segment and drops index entries that
+// don't point at a complete valid record. Valid records that follow the
+// last indexed one are indexed again, the store could be flushed while the
+// index was not, only store bytes after them are truncated. It returns the
+// number of dropped and indexed records and truncated store bytes
+func (s *segment) recover() (uint64, uint64, uint64, error) {
+	// stale entries after the end are indexed again from the store
+	err := s.idx.clearEnd()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	end := s.store.base
+	id := s.idx.id
+
+	// walk back from the last entry until the first record that is valid
+	for id > s.idx.startID {
+		offset, err := s.idx.read(id - 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		_, h, err := s.store.readRecord(offset)
+		if err == nil {
+			end = offset + h.frameSize()
+			break
+		}
+		if !errors.Is(err, ErrCorruptRecord) {
+			return 0, 0, 0, err
+		}
+
+		id--
+	}
+
+	dropped := s.idx.id - id
+	if dropped > 0 {
+		err := s.idx.truncate(id)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	// records without checksums can't be told from garbage,
+	// only versioned ones are indexed again
+	var indexed uint64
+	for end < s.store.size {
+		_, h, err := s.store.readRecord(end)
+		if errors.Is(err, ErrCorruptRecord) || (err == nil && h.version == 0) {
+			break
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if s.idx.free() == 0 {
+			return 0, 0, 0, fmt.Errorf("%s: %w: store has records after the last index entry", s.segmentID, ErrCorruptIndex)
+		}
+
+		_, err = s.idx.write(end)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		end += h.frameSize()
+		indexed++
+	}
+	if indexed > 0 {
+		s.idx.publish()
+		err := s.idx.sync()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	bytes := s.store.size - end
+	if bytes > 0 {
+		err := s.store.truncate(end)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	return dropped, indexed, bytes, nil
+}
+
+// endBatch makes record id the last record of its batch, so the records
+// of the batch before it are not dropped by recovery once the records
+// after it are removed
+func (s *segment) endBatch(id uint64) error {
+	if id < s.idx.startID {
+		return nil
+	}
+
+	offset, err := s.idx.read(id)
+	if err != nil {
+		return err
+	}
+
+	_, h, err := s.store.readRecord(offset)
+	if err != nil {
+		return err
+	}
+
+	return s.store.rewrite(offset, h.flags&^flagBatch)
+}
+
+// truncateAfter removes all records after id from the segment, the index
+// goes first, so removed records could be indexed again by recovery only
+// if the store is not truncated yet.
+// The segment is emptied if id is right before it
+func (s *segment) truncateAfter(id uint64) error {
+	if id < s.idx.startID {
+		err := s.idx.truncate(s.idx.startID)
+		if err != nil {
+			return err
+		}
+
+		return s.store.truncate(s.store.base)
+	}
+
+	offset, err := s.idx.read(id)
+	if err != nil {
+		return err
+	}
+
+	_, h, err := s.store.readRecord(offset)
+	if err != nil {
+		return err
+	}
+
+	err = s.idx.truncate(id + 1)
+	if err != nil {
+		return err
+	}
+
+	return s.store.truncate(offset + h.frameSize())
+}
+
+// lastFlags returns flags of the last record in the segment
+func (s *segment) lastFlags() (byte, error) {
+	if s.empty() {
+		return 0, nil
+	}
+
+	offset, err := s.idx.read(s.idx.id - 1)
 	if err != nil {
 		return 0, err
 	}
 
-	id, err := s.idx.write(offset)
+	_, h, err := s.store.readRecord(offset)
 	if err != nil {
 		return 0, err
 	}
 
-	return id, nil
+	return h.flags, nil
+}
+
+// dropIncompleteBatch removes records of a batch that was not completely
+// written, they are at the end of the segment and all have flagBatch,
+// it returns the number of dropped records and store bytes
+func (s *segment) dropIncompleteBatch() (uint64, uint64, error) {
+	id := s.idx.id
+	for id > s.idx.startID {
+		offset, err := s.idx.read(id - 1)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		_, h, err := s.store.readRecord(offset)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if h.flags&flagBatch == 0 {
+			break
+		}
+
+		id--
+	}
+
+	if id == s.idx.id {
+		return 0, 0, nil
+	}
+
+	// store is cut at the first dropped record
+	end, err := s.idx.read(id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	records := s.idx.id - id
+	err = s.idx.truncate(id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bytes := s.store.size - end
+	err = s.store.truncate(end)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return records, bytes, nil
 }
 
 func (s *segment) close() error {
@@ -53,13 +333,15 @@ func (s *segment) close() error {
 	return nil
 }
 
+// remove deletes segment files, the store goes first because a segment
+// is discovered by its store file
 func (s *segment) remove() error {
-	err := s.idx.remove()
+	err := s.store.remove()
 	if err != nil {
 		return err
 	}
 
-	return s.store.remove()
+	return s.idx.remove()
 }
 
 func newSegment(indexFile string, storeFile string, startID uint64, cfg *Config) (*segment, error) {
@@ -68,8 +350,9 @@ func newSegment(indexFile string, storeFile string, startID uint64, cfg *Config)
 		return nil, err
 	}
 
-	store, err := newStore(storeFile, cfg)
+	store, err := newStore(storeFile, cfg, startID)
 	if err != nil {
+		_ = index.close()
 		return nil, err
 	}
 
@@ -79,5 +362,6 @@ func newSegment(indexFile string, storeFile string, startID uint64, cfg *Config)
 		idx:       index,
 		store:     store,
 		segmentID: sp[0],
+		refs:      1,
 	}, nil
 }
@@ -0,0 +1,72 @@
+package wal
+
+import "sync/atomic"
+
+// Stats describes the state of the log
+type Stats struct {
+	FirstID       uint64
+	LastID        uint64
+	ActiveSegment string
+	Segments      []SegmentStats
+}
+
+// SegmentStats describes a single segment
+type SegmentStats struct {
+	Name    string
+	FirstID uint64
+	// Records is the number of records in the segment including
+	// records before the first id of the log
+	Records    uint64
+	StoreBytes uint64
+	IndexBytes uint64
+	// IndexFill is the ratio of used index entries
+	IndexFill float64
+	// MaxIndexSizeBytes is the space for index entries,
+	// it's the index size the segment was written with
+	MaxIndexSizeBytes uint64
+}
+
+// LastID returns id of the last record, it's FirstID()-1 if the log is empty
+func (w *WAL) LastID() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.activeSegment.idx.committedID() - 1
+}
+
+// SegmentCount returns the number of segments
+func (w *WAL) SegmentCount() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return len(w.segments)
+}
+
+// Stats returns the state of the log and every segment
+func (w *WAL) Stats() Stats {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	stats := Stats{
+		FirstID:       w.firstID(),
+		LastID:        w.activeSegment.idx.committedID() - 1,
+		ActiveSegment: w.activeSegment.segmentID,
+		Segments:      make([]SegmentStats, 0, len(w.segments)),
+	}
+
+	for _, s := range w.segments {
+		records := s.idx.committedID() - s.idx.startID
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name:       s.segmentID,
+			FirstID:    s.idx.startID,
+			Records:    records,
+			StoreBytes: atomic.LoadUint64(&s.store.size),
+			IndexBytes: uint64(len(s.idx.mm)),
+			IndexFill:  float64(records*16) / float64(s.idx.maxSize),
+
+			MaxIndexSizeBytes: s.idx.maxSize,
+		})
+	}
+
+	return stats
+}
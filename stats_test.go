@@ -0,0 +1,60 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 64
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wal.FirstID() != 1 || wal.LastID() != 0 {
+		t.Error("empty log should have first id 1 and last id 0")
+	}
+
+	for i := 0; i < 6; i++ {
+		_, err := wal.Append([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if wal.FirstID() != 1 || wal.LastID() != 6 {
+		t.Errorf("wrong id range %d-%d", wal.FirstID(), wal.LastID())
+	}
+	if wal.SegmentCount() != 2 {
+		t.Errorf("should have 2 segments, got %d", wal.SegmentCount())
+	}
+
+	stats := wal.Stats()
+	if stats.ActiveSegment != segmentName(5) || len(stats.Segments) != 2 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	first := stats.Segments[0]
+	if first.Name != segmentName(1) || first.FirstID != 1 || first.Records != 4 || first.IndexFill != 1 {
+		t.Errorf("wrong first segment stats: %+v", first)
+	}
+	if first.StoreBytes != headerSize+4*(recordHeaderSize+timestampSize+4) || first.IndexBytes != headerSize+64 {
+		t.Errorf("wrong first segment sizes: %+v", first)
+	}
+
+	active := stats.Segments[1]
+	if active.FirstID != 5 || active.Records != 2 || active.IndexFill != 0.5 {
+		t.Errorf("wrong active segment stats: %+v", active)
+	}
+}
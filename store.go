@@ -1,91 +1,411 @@
 package wal
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"sync/atomic"
 )
 
+var ErrCorruptRecord = errors.New("record is corrupted")
+
+const (
+	// recordVersion is stored in the first byte of every record header,
+	// records written before checksums were introduced have zero there
+	recordVersion = 1
+	// legacyHeaderSize is the header size of unversioned records: [size]
+	legacyHeaderSize = 8
+	// recordHeaderSize is the header size of versioned records:
+	// [version (1 byte)][flags (1 byte)][size (6 bytes)][crc32c (4 bytes)]
+	recordHeaderSize = 12
+	maxRecordSize    = 1<<48 - 1
+)
+
+// record flags
+const (
+	// flagBatch marks a record that is followed by more records
+	// of the same batch, the last record of a batch doesn't have it
+	flagBatch = 1 << iota
+	// flagEncrypted marks a record encrypted with a key
+	// from Config.Encryption
+	flagEncrypted
+	// flagTimestamp marks a record with data prefixed by
+	// its append time
+	flagTimestamp
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// recordHeader describes a record frame as it's stored in a store file
+type recordHeader struct {
+	version byte
+	flags   byte
+	size    uint64
+	crc     uint32
+}
+
+// parseRecordHeader decodes the header word of a record, b should hold
+// at least 8 bytes for legacy records and recordHeaderSize for versioned ones
+func parseRecordHeader(b []byte) (recordHeader, error) {
+	word := binary.BigEndian.Uint64(b[0:8])
+	h := recordHeader{version: b[0], flags: b[1], size: word & maxRecordSize}
+
+	switch h.version {
+	case 0:
+		// legacy record, whole word is the size
+		h.size = word
+	case recordVersion:
+		if len(b) < recordHeaderSize {
+			return h, fmt.Errorf("%w: short header", ErrCorruptRecord)
+		}
+		h.crc = binary.BigEndian.Uint32(b[8:12])
+	default:
+		return h, fmt.Errorf("%w: unknown record version %d", ErrCorruptRecord, h.version)
+	}
+
+	return h, nil
+}
+
+// len returns the size of the header itself
+func (h recordHeader) len() uint64 {
+	if h.version == 0 {
+		return legacyHeaderSize
+	}
+
+	return recordHeaderSize
+}
+
+// frameSize returns the size of the header and data
+func (h recordHeader) frameSize() uint64 {
+	return h.len() + h.size
+}
+
+// verify checks that data matches the checksum stored in the header
+func (h recordHeader) verify(data []byte) error {
+	if h.version == 0 {
+		return nil
+	}
+
+	var word [8]byte
+	binary.BigEndian.PutUint64(word[:], uint64(h.version)<<56|uint64(h.flags)<<48|h.size)
+	crc := crc32.Update(crc32.Checksum(word[:], crcTable), crcTable, data)
+	if crc != h.crc {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+
+	return nil
+}
+
+// appendRecord appends framed data to b and returns the extended slice
+func appendRecord(b []byte, data []byte, flags byte) []byte {
+	var hdr [recordHeaderSize]byte
+	binary.BigEndian.PutUint64(hdr[0:8], uint64(recordVersion)<<56|uint64(flags)<<48|uint64(len(data)))
+	crc := crc32.Update(crc32.Checksum(hdr[0:8], crcTable), crcTable, data)
+	binary.BigEndian.PutUint32(hdr[8:12], crc)
+
+	b = append(b, hdr[:]...)
+	return append(b, data...)
+}
+
+// entry is a record data with its flags
+type entry struct {
+	data  []byte
+	flags byte
+}
+
 // store defines a storage abstraction for the log
 // log is append only file
 type store struct {
-	file    *os.File
+	// size is updated atomically, readers check record bounds against it
+	// while records are appended, it's kept first for 64-bit alignment
 	size    uint64
+	fs      FS
+	file    File
 	maxSize uint64
+	// base is the size of the file header, records follow it
+	base   uint64
+	header fileHeader
 }
 
 // newStore returns a new storage
-func newStore(file string, cfg *Config) (*store, error) {
-	st, err := os.Stat(file)
+func newStore(file string, cfg *Config, startID uint64) (*store, error) {
+	// records are always written at the end of the store, but the file
+	// is not opened in append mode so record headers could be rewritten
+	flag := os.O_RDWR
+	if cfg.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := cfg.fs().OpenFile(file, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.OpenFile(file, os.O_APPEND|os.O_RDWR, 0644)
+	st, err := f.Stat()
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
 
-	return &store{
+	// the writer creates the file before it writes the header
+	if cfg.readOnly && st.Size() == 0 {
+		_ = f.Close()
+		return nil, errSegmentNotReady
+	}
+
+	s := &store{
+		fs:      cfg.fs(),
 		file:    f,
 		size:    uint64(st.Size()),
 		maxSize: cfg.Segment.MaxStoreSizeBytes,
-	}, nil
+	}
+
+	err = s.readHeader(startID)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// readHeader reads and validates store header, empty files get a new
+// header, files without header are accepted if they start with a record
+func (s *store) readHeader(startID uint64) error {
+	if s.size == 0 {
+		s.header = newFileHeader(storeKind, startID)
+		_, err := s.file.WriteAt(s.header.marshal(), 0)
+		if err != nil {
+			return err
+		}
+
+		s.size = headerSize
+		s.base = headerSize
+		return s.file.Sync()
+	}
+
+	h, base, err := readStoreHeader(s.file, startID)
+	if err != nil {
+		return err
+	}
+
+	s.header = h
+	s.base = base
+	return nil
+}
+
+// readStoreHeader returns header of a non-empty store and its size,
+// files without header are accepted if they start with a record
+func readStoreHeader(f File, startID uint64) (fileHeader, uint64, error) {
+	b := make([]byte, headerSize)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, 0, err
+	}
+
+	if hasMagic(b[:n]) {
+		h, err := parseFileHeader(b[:n], storeKind)
+		if err != nil {
+			return fileHeader{}, 0, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if h.startID != startID {
+			return fileHeader{}, 0, fmt.Errorf("%s: %w: start id %d, expected %d", f.Name(), ErrInvalidHeader, h.startID, startID)
+		}
+
+		return h, headerSize, nil
+	}
+
+	// legacy store starts with a legacy or versioned record
+	if n == 0 || (b[0] != 0 && b[0] != recordVersion) {
+		return fileHeader{}, 0, fmt.Errorf("%s: %w", f.Name(), ErrInvalidHeader)
+	}
+
+	return fileHeader{startID: startID}, 0, nil
 }
 
 // read takes an offset in a file and returns a record
 func (s *store) read(offset uint64) ([]byte, error) {
-	// read the first 8 bytes to determine the size of the record
-	b := make([]byte, 8)
-	_, err := s.file.ReadAt(b, int64(offset))
+	data, _, err := s.readRecord(offset)
 	if err != nil {
 		return nil, err
 	}
 
-	var size uint64
-	err = binary.Read(bytes.NewReader(b), binary.BigEndian, &size)
+	return data, nil
+}
+
+// readRecord reads and verifies a record at offset,
+// it returns record data and its header
+func (s *store) readRecord(offset uint64) ([]byte, recordHeader, error) {
+	// read the header to determine the version and size of the record,
+	// legacy records have only 8 bytes of header and may be shorter than
+	// a versioned header if they are the last one in the file
+	b := make([]byte, recordHeaderSize)
+	n, err := s.file.ReadAt(b, int64(offset))
+	if n < legacyHeaderSize {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%w: short header at offset %d", ErrCorruptRecord, offset)
+		}
+		return nil, recordHeader{}, err
+	}
+
+	h, err := parseRecordHeader(b[:n])
 	if err != nil {
-		return nil, err
+		return nil, recordHeader{}, err
 	}
 
-	b = make([]byte, size)
-	_, err = s.file.ReadAt(b, int64(offset)+8)
+	end := offset + h.frameSize()
+	if end > atomic.LoadUint64(&s.size) || end < offset {
+		return nil, recordHeader{}, fmt.Errorf("%w: record at offset %d is out of store bounds", ErrCorruptRecord, offset)
+	}
+
+	b = make([]byte, h.size)
+	_, err = s.file.ReadAt(b, int64(offset+h.len()))
 	if err != nil {
-		return nil, err
+		return nil, recordHeader{}, err
+	}
+
+	err = h.verify(b)
+	if err != nil {
+		return nil, recordHeader{}, fmt.Errorf("record at offset %d: %w", offset, err)
+	}
+
+	return b, h, nil
+}
+
+// readFrom reads and verifies the next record from r, limit is the
+// number of bytes that are left in r and guards against corrupted sizes
+func readFrom(r io.Reader, limit uint64) ([]byte, recordHeader, error) {
+	b := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, b[:legacyHeaderSize])
+	if err != nil {
+		return nil, recordHeader{}, err
 	}
 
-	return b, nil
+	// versioned records have the checksum after the header word
+	n := legacyHeaderSize
+	if b[0] != 0 {
+		n = recordHeaderSize
+		_, err = io.ReadFull(r, b[legacyHeaderSize:])
+		if err != nil {
+			return nil, recordHeader{}, err
+		}
+	}
+
+	h, err := parseRecordHeader(b[:n])
+	if err != nil {
+		return nil, recordHeader{}, err
+	}
+
+	if h.frameSize() > limit {
+		return nil, recordHeader{}, fmt.Errorf("%w: record is out of store bounds", ErrCorruptRecord)
+	}
+
+	data := make([]byte, h.size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, recordHeader{}, err
+	}
+
+	err = h.verify(data)
+	if err != nil {
+		return nil, recordHeader{}, err
+	}
+
+	return data, h, nil
 }
 
 // write append the record to the log and return
 func (s *store) write(data []byte) (uint64, error) {
-	if s.size+uint64(len(data)+8) > s.maxSize {
-		return 0, errNoStoreSpaceLeft
+	offsets, err := s.writeBatch([]entry{{data: data}})
+	if err != nil {
+		return 0, err
 	}
 
-	b := make([]byte, 8+len(data))
-	binary.BigEndian.PutUint64(b[0:8], uint64(len(data)))
-	copy(b[8:], data)
+	return offsets[0], nil
+}
+
+// writeBatch appends as many records as fits into the store
+// with a single write and returns their offsets
+func (s *store) writeBatch(entries []entry) ([]uint64, error) {
+	var size uint64
+	n := 0
+	for ; n < len(entries); n++ {
+		recSize := uint64(len(entries[n].data) + recordHeaderSize)
+		if s.size-s.base+size+recSize > s.maxSize {
+			break
+		}
+		size += recSize
+	}
+
+	if n == 0 {
+		return nil, errNoStoreSpaceLeft
+	}
+
+	b := make([]byte, 0, size)
+	offsets := make([]uint64, n)
+	for i, e := range entries[:n] {
+		offsets[i] = s.size + uint64(len(b))
+		b = appendRecord(b, e.data, e.flags)
+	}
 
-	n, err := s.file.Write(b)
+	written, err := s.file.WriteAt(b, int64(s.size))
+	if err == nil && written != len(b) {
+		err = fmt.Errorf("can't write all data")
+	}
 	if err != nil {
-		return 0, err
+		// don't leave a partial record behind
+		_ = s.file.Truncate(int64(s.size))
+		return nil, err
 	}
 
-	if n != len(data)+8 {
-		return 0, fmt.Errorf("can't write all data")
+	atomic.AddUint64(&s.size, size)
+
+	return offsets, nil
+}
+
+// rewrite replaces flags of the record at offset and syncs the store
+func (s *store) rewrite(offset uint64, flags byte) error {
+	data, h, err := s.readRecord(offset)
+	if err != nil {
+		return err
 	}
 
-	err = s.file.Sync()
+	// legacy records have no flags
+	if h.version == 0 || h.flags == flags {
+		return nil
+	}
+
+	b := appendRecord(make([]byte, 0, recordHeaderSize+len(data)), data, flags)
+	_, err = s.file.WriteAt(b[:recordHeaderSize], int64(offset))
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// sync commits written records to disk
+func (s *store) sync() error {
+	return s.file.Sync()
+}
+
+// truncate drops everything in the store after size bytes
+func (s *store) truncate(size uint64) error {
+	err := s.file.Truncate(int64(size))
+	if err != nil {
+		return err
 	}
 
-	offset := s.size
-	s.size += uint64(n)
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
 
-	return offset, nil
+	atomic.StoreUint64(&s.size, size)
+	return nil
 }
 
 func (s *store) close() error {
@@ -93,5 +413,5 @@ func (s *store) close() error {
 }
 
 func (s *store) remove() error {
-	return os.Remove(s.file.Name())
+	return s.fs.Remove(s.file.Name())
 }
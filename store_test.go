@@ -1,6 +1,8 @@
 package wal
 
 import (
+	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -19,7 +21,7 @@ func TestStoreReadWrite(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f.Name(), &defaultConfig)
+	s, err := newStore(f.Name(), &defaultConfig, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,17 +59,17 @@ func TestStoreSize(t *testing.T) {
 	cfg := Config{}
 	cfg.Segment.MaxStoreSizeBytes = 16
 
-	s, err := newStore(f.Name(), &cfg)
+	s, err := newStore(f.Name(), &cfg, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = s.write([]byte("01234567"))
+	_, err = s.write([]byte("0123"))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if s.size != 16 {
+	if s.size != headerSize+16 {
 		t.Error("size is wrong")
 	}
 
@@ -76,3 +78,75 @@ func TestStoreSize(t *testing.T) {
 		t.Error("should return no space left error")
 	}
 }
+
+func TestStoreCorruptRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "store-test-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f.Name(), &defaultConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, err := s.write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit in the record data
+	_, err = f.WriteAt([]byte{'j'}, int64(offset+recordHeaderSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.read(offset)
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("should return ErrCorruptRecord, got %v", err)
+	}
+}
+
+func TestStoreLegacyRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "store-test-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// unversioned [size][data] record
+	b := make([]byte, 8+3)
+	binary.BigEndian.PutUint64(b[0:8], 3)
+	copy(b[8:], "abc")
+	_, err = f.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newStore(f.Name(), &defaultConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, err := s.write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abc" {
+		t.Errorf("legacy record is wrong: %s", data)
+	}
+
+	data, err = s.read(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("record is wrong: %s", data)
+	}
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// timestampSize is the size of the append time that prefixes data of
+// records with flagTimestamp: [unix nanoseconds (8 bytes)][data]
+const timestampSize = 8
+
+// stamp prefixes data of the entry with its append time
+func stamp(e entry, ts int64) entry {
+	b := make([]byte, timestampSize+len(e.data))
+	binary.BigEndian.PutUint64(b[0:timestampSize], uint64(ts))
+	copy(b[timestampSize:], e.data)
+
+	return entry{data: b, flags: e.flags | flagTimestamp}
+}
+
+// splitTimestamp returns append time of a record stored with flags and
+// its data without the time, records written before timestamps were
+// introduced have zero time
+func splitTimestamp(data []byte, flags byte) (int64, []byte, error) {
+	if flags&flagTimestamp == 0 {
+		return 0, data, nil
+	}
+	if len(data) < timestampSize {
+		return 0, nil, fmt.Errorf("%w: short timestamp", ErrCorruptRecord)
+	}
+
+	return int64(binary.BigEndian.Uint64(data[0:timestampSize])), data[timestampSize:], nil
+}
+
+// timestamp returns append time of the next commit, it never goes back
+// even if the clock does, so records are ordered by time as they are by id
+func (w *WAL) timestamp() int64 {
+	ts := w.now().UnixNano()
+	if ts < w.lastTime {
+		ts = w.lastTime
+	}
+	w.lastTime = ts
+
+	return ts
+}
+
+// expired reports whether the first record of the active segment was
+// appended more than MaxAge ago, empty segments don't expire and segments
+// that start with a record without a timestamp expire right away
+func (w *WAL) expired() (bool, error) {
+	maxAge := w.config.Segment.MaxAge
+	if maxAge <= 0 || w.activeSegment.empty() {
+		return false, nil
+	}
+
+	if w.activeTime == 0 {
+		s := w.activeSegment
+		data, h, err := s.store.readRecord(s.store.base)
+		if err != nil {
+			return false, err
+		}
+		w.activeTime, _, err = splitTimestamp(data, h.flags)
+		if err != nil {
+			return false, err
+		}
+		if w.activeTime == 0 {
+			return true, nil
+		}
+	}
+
+	return w.now().Sub(time.Unix(0, w.activeTime)) >= maxAge, nil
+}
+
+// lastTimestamp returns append time of the last record in segments
+func lastTimestamp(segments []*segment) (int64, error) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		if s.empty() {
+			continue
+		}
+
+		data, h, err := s.readRecord(s.idx.id - 1)
+		if err != nil {
+			return 0, err
+		}
+		ts, _, err := splitTimestamp(data, h.flags)
+
+		return ts, err
+	}
+
+	return 0, nil
+}
+
+// recordTime returns append time of a committed record
+func (w *WAL) recordTime(id uint64) (int64, error) {
+	s, err := w.acquireSegment(id)
+	if err != nil {
+		return 0, err
+	}
+	defer s.release()
+
+	data, h, err := s.readRecord(id)
+	if err != nil {
+		return 0, err
+	}
+	ts, _, err := splitTimestamp(data, h.flags)
+
+	return ts, err
+}
+
+// SeekTime returns id of the first record appended at or after t,
+// records written before timestamps were introduced are older than any t.
+// ErrRecordNotFound is returned if all records are older than t
+func (w *WAL) SeekTime(t time.Time) (uint64, error) {
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return 0, ErrClosed
+	}
+	first, end := w.firstID(), w.activeSegment.idx.committedID()
+	w.mu.RUnlock()
+
+	// records are ordered by time, find the first one that is not older
+	target := t.UnixNano()
+	lo, hi := first, end
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		ts, err := w.recordTime(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if ts < target {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == end {
+		return 0, ErrRecordNotFound
+	}
+
+	return lo, nil
+}
@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestSeekTime(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 48
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	cfg.FS = NewMemFS()
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// the first record was written before timestamps were introduced
+	_, err = wal.activeSegment.write([]byte("legacy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	clock := &testClock{t: start}
+	wal.now = clock.now
+
+	// ids 2..11, a second apart, spanning several segments
+	for i := 2; i <= 11; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Second)
+	}
+	if wal.SegmentCount() < 3 {
+		t.Fatalf("records should span several segments, got %d", wal.SegmentCount())
+	}
+
+	tests := []struct {
+		t  time.Time
+		id uint64
+	}{
+		{start.Add(-time.Hour), 2},
+		{start, 2},
+		{start.Add(time.Millisecond), 3},
+		{start.Add(5 * time.Second), 7},
+		{start.Add(9 * time.Second), 11},
+	}
+	for _, tt := range tests {
+		id, err := wal.SeekTime(tt.t)
+		if err != nil || id != tt.id {
+			t.Errorf("SeekTime(%v) = %d, %v, expected %d", tt.t.Sub(start), id, err, tt.id)
+		}
+	}
+
+	_, err = wal.SeekTime(start.Add(10 * time.Second))
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("should return ErrRecordNotFound after the last record, got %v", err)
+	}
+
+	// records keep their order if the clock goes back
+	clock.advance(-time.Hour)
+	id, err := wal.Append([]byte("record 12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := wal.recordTime(id)
+	if err != nil || ts != start.Add(9*time.Second).UnixNano() {
+		t.Errorf("record appended after the clock went back should get the last time, got %v, %v", time.Unix(0, ts).Sub(start), err)
+	}
+	found, err := wal.SeekTime(start.Add(9 * time.Second))
+	if err != nil || found != 11 {
+		t.Errorf("SeekTime should return the first record of the same time, got %d, %v", found, err)
+	}
+
+	data, err := wal.Read(id)
+	if err != nil || string(data) != "record 12" {
+		t.Errorf("wrong record data %q, %v", data, err)
+	}
+
+	err = wal.TruncateBefore(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = wal.SeekTime(start)
+	if err != nil || id != 5 {
+		t.Errorf("SeekTime should start with the first record, got %d, %v", id, err)
+	}
+}
+
+func TestSeekTimeReopen(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 1024
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	cfg.FS = NewMemFS()
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	clock := &testClock{t: start.Add(time.Hour)}
+	wal.now = clock.now
+
+	_, err = wal.Append([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened log continues with the time of the last record
+	wal, err = New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	clock.t = start
+	wal.now = clock.now
+
+	id, err := wal.Append([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := wal.recordTime(id)
+	if err != nil || ts != start.Add(time.Hour).UnixNano() {
+		t.Errorf("wrong append time %v, %v", time.Unix(0, ts), err)
+	}
+
+	_, err = wal.SeekTime(start.Add(time.Hour + time.Nanosecond))
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("should return ErrRecordNotFound, got %v", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 1024
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	cfg.Segment.MaxAge = time.Minute
+	cfg.FS = NewMemFS()
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	clock := &testClock{t: time.Now()}
+	wal.now = clock.now
+
+	// empty segment doesn't expire
+	clock.advance(2 * time.Minute)
+	_, err = wal.Append([]byte("r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(30 * time.Second)
+	_, err = wal.Append([]byte("r2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.SegmentCount() != 1 {
+		t.Fatalf("segment should not be rolled before it expires, got %d segments", wal.SegmentCount())
+	}
+
+	// the first record of the segment is older than MaxAge
+	clock.advance(time.Minute)
+	id, _, err := wal.AppendBatch([][]byte{[]byte("r3"), []byte("r4")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.SegmentCount() != 2 || wal.activeSegment.idx.startID != id {
+		t.Errorf("expired segment should be rolled, got %d segments", wal.SegmentCount())
+	}
+
+	for i := uint64(1); i <= 4; i++ {
+		data, err := wal.Read(i)
+		if err != nil || string(data) != fmt.Sprintf("r%d", i) {
+			t.Errorf("wrong record %d: %q, %v", i, data, err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrIDGap          = errors.New("records are missing between segments")
+	ErrIDOverlap      = errors.New("segments hold the same records")
+	ErrOffsetMismatch = errors.New("index offset doesn't match a record")
+)
+
+// Report is the result of Verify
+type Report struct {
+	FirstID  uint64
+	LastID   uint64
+	Records  uint64
+	Segments []SegmentReport
+	Problems []Problem
+}
+
+// OK reports whether no problems were found
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// SegmentReport describes a verified segment
+type SegmentReport struct {
+	Name    string
+	FirstID uint64
+	// Records is the number of index entries that point at valid records
+	Records    uint64
+	StoreBytes uint64
+	IndexBytes uint64
+}
+
+// Problem is an inconsistency found by Verify, Err is one of ErrCorruptRecord,
+// ErrCorruptIndex, ErrInvalidHeader, ErrIDGap, ErrIDOverlap or ErrOffsetMismatch
+// wrapped with details, ID and Offset are zero if they are not known
+type Problem struct {
+	Segment string
+	ID      uint64
+	Offset  uint64
+	Err     error
+}
+
+func (p Problem) Error() string {
+	s := "segment " + p.Segment
+	if p.ID != 0 {
+		s += fmt.Sprintf(" record %d", p.ID)
+	}
+	if p.Offset != 0 {
+		s += fmt.Sprintf(" offset %d", p.Offset)
+	}
+
+	return s + ": " + p.Err.Error()
+}
+
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+// Verify checks the log in dir without modifying it: every index entry
+// should point at the boundary of a valid record, every record in a store
+// should be indexed and segments should continue each other without gaps
+// or overlaps. Found inconsistencies are returned in the report, the error
+// is returned only if the log can't be read. The log should not be written
+// while it's verified
+func Verify(dir string) (Report, error) {
+	return VerifyFS(OSFS, dir)
+}
+
+// VerifyFS checks the log in dir stored in fs like Verify does
+func VerifyFS(fs FS, dir string) (Report, error) {
+	var report Report
+
+	files, err := listSegments(fs, dir)
+	if err != nil {
+		return report, err
+	}
+
+	m, err := readMeta(fs, dir)
+	if err != nil {
+		report.Problems = append(report.Problems, Problem{Segment: metaFile, Err: err})
+	}
+
+	// nextID is the id expected at the beginning of the next segment
+	var nextID uint64
+	for i, file := range files {
+		indexPath := filepath.Join(dir, file.name+".index")
+		storePath := filepath.Join(dir, file.name+".store")
+
+		startID := file.num
+		if file.legacy {
+			startID, err = legacyStartID(fs, indexPath)
+			if errors.Is(err, ErrIndexRecordID) {
+				err = fmt.Errorf("%w: %v", ErrCorruptIndex, err)
+			}
+			if err != nil {
+				report.Problems = append(report.Problems, Problem{Segment: file.name, Err: err})
+				continue
+			}
+			// empty legacy segment continues the previous one
+			if startID == 0 {
+				startID = nextID
+			}
+			if startID == 0 {
+				startID = 1
+			}
+		}
+
+		if i > 0 && startID > nextID {
+			report.Problems = append(report.Problems, Problem{Segment: file.name, ID: startID,
+				Err: fmt.Errorf("%w: segment starts with %d, expected %d", ErrIDGap, startID, nextID)})
+		}
+		if i > 0 && startID < nextID {
+			report.Problems = append(report.Problems, Problem{Segment: file.name, ID: startID,
+				Err: fmt.Errorf("%w: segment starts with %d, expected %d", ErrIDOverlap, startID, nextID)})
+		}
+
+		sr, problems, err := verifySegment(fs, indexPath, storePath, file.name, startID)
+		if err != nil {
+			return report, err
+		}
+
+		report.Segments = append(report.Segments, sr)
+		report.Problems = append(report.Problems, problems...)
+		nextID = startID + sr.Records
+	}
+
+	if len(report.Segments) > 0 {
+		report.FirstID = report.Segments[0].FirstID
+		if m.firstID > report.FirstID {
+			report.FirstID = m.firstID
+		}
+		report.LastID = nextID - 1
+		if report.LastID+1 > report.FirstID {
+			report.Records = report.LastID + 1 - report.FirstID
+		}
+	}
+
+	return report, nil
+}
+
+// verifySegment checks index entries of a segment against its store,
+// it returns the segment report and the problems it found
+func verifySegment(fs FS, indexPath, storePath, name string, startID uint64) (SegmentReport, []Problem, error) {
+	sr := SegmentReport{Name: name, FirstID: startID}
+	var problems []Problem
+	problem := func(id, offset uint64, err error) {
+		problems = append(problems, Problem{Segment: name, ID: id, Offset: offset, Err: err})
+	}
+
+	offsets, indexBytes, err := readIndexEntries(fs, indexPath, startID)
+	if errors.Is(err, ErrInvalidHeader) || errors.Is(err, ErrCorruptIndex) {
+		problem(0, 0, err)
+	} else if err != nil {
+		return sr, nil, err
+	}
+	sr.IndexBytes = indexBytes
+
+	records, end, storeBytes, err := readStoreRecords(fs, storePath, startID)
+	if errors.Is(err, ErrInvalidHeader) || errors.Is(err, ErrCorruptRecord) {
+		problem(0, end, err)
+	} else if err != nil {
+		return sr, nil, err
+	}
+	sr.StoreBytes = storeBytes
+
+	// the n-th index entry should point at the n-th record
+	for n, offset := range offsets {
+		id := startID + uint64(n)
+		if n >= len(records) {
+			problem(id, offset, fmt.Errorf("%w: no record at the offset", ErrOffsetMismatch))
+			break
+		}
+		if records[n].offset != offset {
+			problem(id, offset, fmt.Errorf("%w: record is at offset %d", ErrOffsetMismatch, records[n].offset))
+			break
+		}
+		sr.Records++
+	}
+
+	if len(records) > len(offsets) && uint64(len(offsets)) == sr.Records {
+		r := records[len(offsets)]
+		problem(startID+sr.Records, r.offset, fmt.Errorf("%w: %d records are not indexed", ErrOffsetMismatch, len(records)-len(offsets)))
+	}
+
+	return sr, problems, nil
+}
+
+// readIndexEntries returns offsets of index entries and the size of the
+// index file, entries end at the first empty slot, entries that don't
+// hold the expected id and entries after the end are reported as corrupted
+func readIndexEntries(fs FS, path string, startID uint64) ([]uint64, uint64, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b := make([]byte, st.Size())
+	_, err = f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if len(b) == 0 {
+		return nil, 0, nil
+	}
+
+	_, base, err := readIndexHeader(f, startID)
+	if err != nil {
+		return nil, uint64(len(b)), err
+	}
+	if uint64(len(b)) < base {
+		return nil, uint64(len(b)), fmt.Errorf("%w: short header", ErrInvalidHeader)
+	}
+
+	var offsets []uint64
+	entries := b[base:]
+	i := 0
+	for ; i+16 <= len(entries); i += 16 {
+		id := binary.BigEndian.Uint64(entries[i : i+8])
+		if id == 0 {
+			break
+		}
+
+		expected := startID + uint64(len(offsets))
+		if id != expected {
+			return offsets, uint64(len(b)), fmt.Errorf("%w: entry %d holds id %d, expected %d", ErrCorruptIndex, i/16, id, expected)
+		}
+		offsets = append(offsets, binary.BigEndian.Uint64(entries[i+8:i+16]))
+	}
+
+	for ; i < len(entries); i++ {
+		if entries[i] != 0 {
+			return offsets, uint64(len(b)), fmt.Errorf("%w: data after the last entry at %d", ErrCorruptIndex, base+uint64(i))
+		}
+	}
+
+	return offsets, uint64(len(b)), nil
+}
+
+// storeRecord is a boundary of a record found in a store
+type storeRecord struct {
+	offset uint64
+	end    uint64
+}
+
+// readStoreRecords reads records of a store sequentially, it returns the
+// records that are valid, the offset where reading stopped and the store
+// size, the error describes the record at that offset
+func readStoreRecords(fs FS, path string, startID uint64) ([]storeRecord, uint64, uint64, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size := uint64(st.Size())
+	if size == 0 {
+		return nil, 0, 0, nil
+	}
+
+	_, base, err := readStoreHeader(f, startID)
+	if err != nil {
+		return nil, 0, size, err
+	}
+
+	var records []storeRecord
+	r := bufio.NewReaderSize(io.NewSectionReader(f, int64(base), int64(size-base)), iteratorBufferSize)
+	offset := base
+	for offset < size {
+		_, h, err := readFrom(r, size-offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: torn record", ErrCorruptRecord)
+		}
+		if err != nil {
+			return records, offset, size, err
+		}
+
+		records = append(records, storeRecord{offset: offset, end: offset + h.frameSize()})
+		offset += h.frameSize()
+	}
+
+	return records, offset, size, nil
+}
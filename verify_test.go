@@ -0,0 +1,172 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newVerifyLog writes 6 records into 3 segments and returns its directory
+func newVerifyLog(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "wal-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		_, err := wal.Append([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func modifyFile(t *testing.T, path string, modify func(b []byte) []byte) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, modify(b), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := newVerifyLog(t)
+	defer os.RemoveAll(dir)
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report.FirstID != 1 || report.LastID != 6 || report.Records != 6 || len(report.Segments) != 3 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	for i, s := range report.Segments {
+		if s.Name != segmentName(uint64(i*2+1)) || s.FirstID != uint64(i*2+1) || s.Records != 2 {
+			t.Errorf("unexpected segment report: %+v", s)
+		}
+	}
+}
+
+func TestVerifyProblems(t *testing.T) {
+	second := segmentName(3)
+
+	tests := []struct {
+		name    string
+		corrupt func(dir string)
+		err     error
+	}{
+		{"corrupted record", func(dir string) {
+			modifyFile(t, filepath.Join(dir, second+".store"), func(b []byte) []byte {
+				b[len(b)-1] ^= 0xff
+				return b
+			})
+		}, ErrCorruptRecord},
+		{"not indexed record", func(dir string) {
+			modifyFile(t, filepath.Join(dir, second+".store"), func(b []byte) []byte {
+				return appendRecord(b, []byte("data"), 0)
+			})
+		}, ErrOffsetMismatch},
+		{"wrong offset", func(dir string) {
+			modifyFile(t, filepath.Join(dir, second+".index"), func(b []byte) []byte {
+				binary.BigEndian.PutUint64(b[headerSize+24:headerSize+32], 1)
+				return b
+			})
+		}, ErrOffsetMismatch},
+		{"wrong id", func(dir string) {
+			modifyFile(t, filepath.Join(dir, second+".index"), func(b []byte) []byte {
+				binary.BigEndian.PutUint64(b[headerSize+16:headerSize+24], 7)
+				return b
+			})
+		}, ErrCorruptIndex},
+		{"invalid header", func(dir string) {
+			modifyFile(t, filepath.Join(dir, second+".index"), func(b []byte) []byte {
+				b[10] ^= 0xff
+				return b
+			})
+		}, ErrInvalidHeader},
+		{"missing segment", func(dir string) {
+			_ = os.Remove(filepath.Join(dir, second+".store"))
+			_ = os.Remove(filepath.Join(dir, second+".index"))
+		}, ErrIDGap},
+		{"overlapping segment", func(dir string) {
+			// the last segment loses its second record
+			modifyFile(t, filepath.Join(dir, segmentName(5)+".index"), func(b []byte) []byte {
+				for i := headerSize + 16; i < headerSize+32; i++ {
+					b[i] = 0
+				}
+				return b
+			})
+			for _, ext := range []string{".index", ".store"} {
+				err := os.Rename(filepath.Join(dir, segmentName(5)+ext), filepath.Join(dir, segmentName(4)+ext))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			modifyFile(t, filepath.Join(dir, segmentName(4)+".index"), func(b []byte) []byte {
+				h := newFileHeader(indexKind, 4)
+				copy(b, h.marshal())
+				binary.BigEndian.PutUint64(b[headerSize:headerSize+8], 4)
+				return b
+			})
+			modifyFile(t, filepath.Join(dir, segmentName(4)+".store"), func(b []byte) []byte {
+				h := newFileHeader(storeKind, 4)
+				copy(b, h.marshal())
+				return b
+			})
+		}, ErrIDOverlap},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newVerifyLog(t)
+			defer os.RemoveAll(dir)
+
+			tt.corrupt(dir)
+
+			report, err := Verify(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.OK() {
+				t.Fatal("problem should be found")
+			}
+
+			found := false
+			for _, p := range report.Problems {
+				if errors.Is(p, tt.err) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected %v, got %v", tt.err, report.Problems)
+			}
+		})
+	}
+}
@@ -4,222 +4,786 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// WAL is safe for concurrent use, readers don't block appends: they only
+// look up a segment under a read lock and read committed records after that
 type WAL struct {
 	dir           string
 	activeSegment *segment
 	segments      []*segment
-	mu            sync.Mutex
-	config        *Config
+	// mu guards the list of segments, writeMu serializes everything that
+	// modifies segments, the list is changed only with both of them held
+	mu       sync.RWMutex
+	writeMu  sync.Mutex
+	config   *Config
+	recovery RecoveryReport
+	// unsynced is the number of appends since the last flush
+	unsynced uint64
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// queue holds appends waiting for group commit,
+	// the first request in the queue is the commit leader
+	queue     []*appendRequest
+	queueMu   sync.Mutex
+	queueCond *sync.Cond
+
+	// appended is closed and replaced when new records are committed
+	appended chan struct{}
+
+	// lowWater is the first visible id set by TruncateBefore
+	lowWater uint64
+
+	// now is the clock of append times, lastTime is append time of the
+	// last record and activeTime is append time of the first record in
+	// the active segment, it's zero if it's not known yet
+	now        func() time.Time
+	lastTime   int64
+	activeTime int64
+
+	// failed is set if a failed write couldn't be undone
+	failed    error
+	closed    bool
+	closeOnce sync.Once
+	lock      io.Closer
+}
+
+// RecoveryReport describes what was dropped from the tail of the log
+// while opening it, a torn write after a crash leaves index entries
+// that point at incomplete records or store bytes that are not indexed,
+// valid records that are not indexed are indexed again
+type RecoveryReport struct {
+	// Segment is the name of the active segment after recovery
+	Segment string
+	// DroppedRecords is the number of indexed records that were removed
+	DroppedRecords uint64
+	// IndexedRecords is the number of valid records that were missing
+	// from the index and were indexed again
+	IndexedRecords uint64
+	// TruncatedBytes is the number of bytes cut from store files
+	TruncatedBytes uint64
+	// RemovedSegments is the number of segments that were removed
+	// because they held no records or only records of an incomplete batch,
+	// or followed a segment that Repair couldn't rebuild
+	RemovedSegments int
 }
 
 var (
-	ErrRecordNotFound   = errors.New("record is not found")
-	ErrIndexRecordID    = errors.New("cant read record id from index")
-	errNoStoreSpaceLeft = errors.New("no store space left")
-	errNoIndexSpaceLeft = errors.New("no index space left")
+	ErrRecordNotFound     = errors.New("record is not found")
+	ErrClosed             = errors.New("log is closed")
+	ErrIndexRecordID      = errors.New("cant read record id from index")
+	ErrRecordTooLarge     = errors.New("record doesn't fit into a segment")
+	ErrInvalidSegmentName = errors.New("invalid segment name")
+	errNoStoreSpaceLeft   = errors.New("no store space left")
+	errNoIndexSpaceLeft   = errors.New("no index space left")
 )
 
 // New creates a Write Ahead Log in specified directory
 // it will look for files [d+].store and [d+].index
 // if no such files are present it will create an
-// empty ones: 0001.index and 0001.store
+// empty ones: 00000000000000000001.index and 00000000000000000001.store,
+// New takes an exclusive lock of the directory, ErrLocked is returned
+// if the log is already opened
 func New(dir string, cfg *Config) (*WAL, error) {
-	var walConfig = Config{}
-	if cfg == nil {
-		walConfig = defaultConfig
-	} else {
-		walConfig = *cfg
+	fs := OSFS
+	if cfg != nil && cfg.FS != nil {
+		fs = cfg.FS
 	}
 
-	files, err := ioutil.ReadDir(dir)
+	lock, err := lockDir(fs, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() < files[j].Name()
-	})
+	wal, err := open(dir, cfg)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	wal.lock = lock
 
-	var segments []*segment
-	var startID uint64 = 1
+	return wal, nil
+}
 
-	for _, file := range files {
-		if strings.Contains(file.Name(), ".store") {
-			sp := strings.Split(file.Name(), ".")
-			indexPath := filepath.Join(dir, sp[0]+".index")
-			storePath := filepath.Join(dir, file.Name())
+func open(dir string, cfg *Config) (*WAL, error) {
+	var walConfig = Config{}
+	if cfg == nil {
+		walConfig = defaultConfig
+	} else {
+		walConfig = *cfg
+	}
+	walConfig.FS = walConfig.fs()
 
-			//read first 8 bytes from segment file
-			iStat, err := os.Stat(indexPath)
-			if err != nil {
-				return nil, err
-			}
+	if c := walConfig.Compression; c != nil && (c.ID() == 0 || c.ID() > maxCodecID) {
+		return nil, ErrInvalidCodec
+	}
 
-			if iStat.Size() > 0 {
-				// read first 8 bytes to get startID for segment
-				f, err := os.Open(indexPath)
-				if err != nil {
-					return nil, err
-				}
-				b := make([]byte, 8)
-				n, err := f.Read(b)
-				if err != nil {
-					return nil, err
-				}
-				if n != 8 {
-					return nil, ErrIndexRecordID
-				}
-
-				startID = binary.BigEndian.Uint64(b)
-			}
+	files, err := listSegments(walConfig.FS, dir)
+	if err != nil {
+		return nil, err
+	}
 
-			segment, err := newSegment(indexPath, storePath, startID, &walConfig)
-			if err != nil {
-				return nil, fmt.Errorf("can't initiate segment: %w", err)
-			}
+	segments, err := openSegments(dir, files, &walConfig, nil)
+	if err != nil {
+		return nil, err
+	}
 
-			segments = append(segments, segment)
-		}
+	if walConfig.readOnly && len(segments) == 0 {
+		return nil, fmt.Errorf("no segments in %s: %w", dir, os.ErrNotExist)
 	}
 
 	// no segments are present starting new log
 	if len(segments) == 0 {
-		indexPath := filepath.Join(dir, "0001.index")
-		f, err := os.Create(indexPath)
+		indexPath := filepath.Join(dir, segmentName(1)+".index")
+		err := createFile(walConfig.FS, indexPath)
 		if err != nil {
 			return nil, err
 		}
-		_ = f.Close()
 
-		storePath := filepath.Join(dir, "0001.store")
-		f, err = os.Create(storePath)
+		storePath := filepath.Join(dir, segmentName(1)+".store")
+		err = createFile(walConfig.FS, storePath)
 		if err != nil {
 			return nil, err
 		}
-		_ = f.Close()
 
 		segment, err := newSegment(indexPath, storePath, 1, &walConfig)
 		if err != nil {
 			return nil, err
 		}
 
+		err = walConfig.FS.SyncDir(dir)
+		if err != nil {
+			_ = segment.release()
+			return nil, err
+		}
+
 		segments = append(segments, segment)
 	}
 
+	// read-only log leaves the tail to the writer
+	report := RecoveryReport{Segment: segments[len(segments)-1].segmentID}
+	if !walConfig.readOnly {
+		var repaired RecoveryReport
+		if walConfig.repair {
+			segments, repaired, err = repairSealed(walConfig.FS, dir, segments)
+			if err != nil {
+				releaseSegments(segments)
+				return nil, err
+			}
+		}
+
+		segments, report, err = recoverTail(segments)
+		if err != nil {
+			releaseSegments(segments)
+			return nil, err
+		}
+		report.DroppedRecords += repaired.DroppedRecords
+		report.IndexedRecords += repaired.IndexedRecords
+		report.TruncatedBytes += repaired.TruncatedBytes
+		report.RemovedSegments += repaired.RemovedSegments
+
+		// sealed segments are not recovered, an index that lost
+		// entries leaves a gap before the next segment
+		for i := 0; i < len(segments)-1; i++ {
+			err = segments[i].idx.checkEnd()
+			if err != nil {
+				releaseSegments(segments)
+				return nil, err
+			}
+
+			end, next := segments[i].idx.id, segments[i+1].idx.startID
+			if end != next {
+				releaseSegments(segments)
+				return nil, fmt.Errorf("%s: %w: segment ends with %d, next segment starts with %d",
+					segments[i].segmentID, ErrCorruptIndex, end-1, next)
+			}
+		}
+	}
+
+	m, err := readMeta(walConfig.FS, dir)
+	if err != nil {
+		releaseSegments(segments)
+		return nil, err
+	}
+
+	var lastTime int64
+	if !walConfig.readOnly {
+		lastTime, err = lastTimestamp(segments)
+		if err != nil {
+			releaseSegments(segments)
+			return nil, err
+		}
+	}
+
 	wal := &WAL{
 		dir:           dir,
 		activeSegment: segments[len(segments)-1],
-		mu:            sync.Mutex{},
 		segments:      segments,
 		config:        &walConfig,
+		recovery:      report,
+		done:          make(chan struct{}),
+		appended:      make(chan struct{}),
+		lowWater:      m.firstID,
+		now:           time.Now,
+		lastTime:      lastTime,
+	}
+	wal.queueCond = sync.NewCond(&wal.queueMu)
+
+	if walConfig.Sync.mode == syncInterval {
+		wal.wg.Add(1)
+		go wal.syncLoop(walConfig.Sync.interval)
 	}
 
 	return wal, nil
 }
 
-// Append add data to the log returns record id and error if any
-func (w *WAL) Append(data []byte) (uint64, error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// openSegments opens segments of files in order, segments from prev are
+// reused if their files were not changed since they were opened. A read-only
+// log stops at the first segment that is still being created by the writer
+func openSegments(dir string, files []segmentFile, cfg *Config, prev []*segment) ([]*segment, error) {
+	var segments []*segment
+	var opened []*segment
+
+	for _, file := range files {
+		if s := findUnchanged(prev, file.name); s != nil {
+			segments = append(segments, s)
+			continue
+		}
+
+		var startID uint64
+		var err error
+		indexPath := filepath.Join(dir, file.name+".index")
+		storePath := filepath.Join(dir, file.name+".store")
+
+		if file.legacy {
+			startID, err = legacyStartID(cfg.FS, indexPath)
+			if err != nil {
+				releaseSegments(opened)
+				return nil, err
+			}
+
+			// segment was created but nothing made it to the index,
+			// it continues right after the previous one
+			if startID == 0 && len(segments) > 0 {
+				startID = segments[len(segments)-1].idx.id
+			}
+			if startID == 0 {
+				startID = 1
+			}
+		} else {
+			startID = file.num
+		}
 
-	id, err := w.activeSegment.write(data)
-	// no more space for index or store, create new one
-	if errors.Is(err, errNoIndexSpaceLeft) || errors.Is(err, errNoStoreSpaceLeft) {
-		nID := nextID(w.activeSegment.segmentID)
-		indexF, err := os.Create(filepath.Join(w.dir, nID+".index"))
+		segment, err := newSegment(indexPath, storePath, startID, cfg)
+		if cfg.readOnly && errors.Is(err, errSegmentNotReady) {
+			break
+		}
 		if err != nil {
-			return 0, err
+			releaseSegments(opened)
+			return nil, fmt.Errorf("can't initiate segment: %w", err)
 		}
-		storeF, err := os.Create(filepath.Join(w.dir, nID+".store"))
+
+		segments = append(segments, segment)
+		opened = append(opened, segment)
+	}
+
+	return segments, nil
+}
+
+// releaseSegments drops the references to segments
+func releaseSegments(segments []*segment) {
+	for _, s := range segments {
+		_ = s.release()
+	}
+}
+
+// recoverTail brings the end of the log to a consistent state, torn records
+// of the active segment are dropped and so are records of a batch that was
+// not completely written, such batch could span several segments, segments
+// that hold only records of that batch are removed. Segments that are
+// still open are returned on error too
+func recoverTail(segments []*segment) ([]*segment, RecoveryReport, error) {
+	var report RecoveryReport
+
+	// empty segments at the end are left by a roll that didn't complete,
+	// the segment before them could be torn as well
+	for len(segments) > 1 && segments[len(segments)-1].empty() {
+		last := segments[len(segments)-1]
+		segments = segments[:len(segments)-1]
+		err := last.close()
 		if err != nil {
-			return 0, err
+			return segments, report, err
+		}
+		err = last.remove()
+		if err != nil {
+			return segments, report, err
 		}
-		_ = indexF.Close()
-		_ = storeF.Close()
 
-		nSeg, err := newSegment(indexF.Name(), storeF.Name(),
-			w.activeSegment.idx.id, w.config)
+		report.RemovedSegments++
+	}
+
+	// only the active segment could be left in a torn state
+	active := segments[len(segments)-1]
+	records, indexed, bytes, err := active.recover()
+	if err != nil {
+		return segments, report, fmt.Errorf("can't recover segment %s: %w", active.segmentID, err)
+	}
+	report.DroppedRecords += records
+	report.IndexedRecords += indexed
+	report.TruncatedBytes += bytes
+
+	for {
+		active = segments[len(segments)-1]
+		records, bytes, err := active.dropIncompleteBatch()
 		if err != nil {
-			return 0, err
+			return segments, report, fmt.Errorf("can't recover segment %s: %w", active.segmentID, err)
 		}
+		report.DroppedRecords += records
+		report.TruncatedBytes += bytes
 
-		w.segments = append(w.segments, nSeg)
-		w.activeSegment = nSeg
+		if !active.empty() || len(segments) == 1 {
+			break
+		}
 
-		id, err := w.activeSegment.write(data)
+		flags, err := segments[len(segments)-2].lastFlags()
 		if err != nil {
-			return 0, err
+			return segments, report, err
+		}
+		if flags&flagBatch == 0 {
+			break
+		}
+
+		// segment was started by the incomplete batch
+		segments = segments[:len(segments)-1]
+		err = active.close()
+		if err != nil {
+			return segments, report, err
+		}
+		err = active.remove()
+		if err != nil {
+			return segments, report, err
 		}
 
-		return id, nil
+		report.RemovedSegments++
+	}
+
+	report.Segment = segments[len(segments)-1].segmentID
+
+	return segments, report, nil
+}
+
+// Repair opens the log in dir like New, indexes of sealed segments that New
+// rejects with ErrCorruptIndex are rebuilt from their stores. If a segment
+// still doesn't continue into the next one, the segments after it are
+// removed, so the log ends with the last segment that could be repaired
+func Repair(dir string, cfg *Config) (*WAL, error) {
+	repairCfg := defaultConfig
+	if cfg != nil {
+		repairCfg = *cfg
+	}
+	repairCfg.repair = true
+
+	return New(dir, &repairCfg)
+}
+
+// repairSealed rebuilds indexes of sealed segments that have data after
+// their end or don't continue into the next segment, segments after the
+// first one that can't be rebuilt are removed with their records
+func repairSealed(fs FS, dir string, segments []*segment) ([]*segment, RecoveryReport, error) {
+	var report RecoveryReport
+
+	for i := 0; i < len(segments)-1; i++ {
+		s := segments[i]
+		if s.idx.checkEnd() == nil && s.idx.id == segments[i+1].idx.startID {
+			continue
+		}
+
+		records, indexed, bytes, err := s.recover()
+		if err != nil {
+			return segments, report, fmt.Errorf("can't repair segment %s: %w", s.segmentID, err)
+		}
+		report.DroppedRecords += records
+		report.IndexedRecords += indexed
+		report.TruncatedBytes += bytes
+		if s.idx.id == segments[i+1].idx.startID {
+			continue
+		}
+
+		// records right after the segment are lost
+		for len(segments) > i+1 {
+			last := segments[len(segments)-1]
+			segments = segments[:len(segments)-1]
+			report.DroppedRecords += last.idx.id - last.idx.startID
+			err := last.close()
+			if err != nil {
+				return segments, report, err
+			}
+			err = last.remove()
+			if err != nil {
+				return segments, report, err
+			}
+
+			report.RemovedSegments++
+		}
+
+		return segments, report, fs.SyncDir(dir)
+	}
+
+	return segments, report, nil
+}
+
+// Recovery returns what was dropped from the log tail when it was opened
+func (w *WAL) Recovery() RecoveryReport {
+	return w.recovery
+}
+
+// Append add data to the log returns record id and error if any,
+// concurrent appends are committed together with a single write and sync.
+// Records that don't fit into an empty segment are rejected with
+// ErrRecordTooLarge before anything is written, records of an append
+// that failed are removed and never become visible
+func (w *WAL) Append(data []byte) (uint64, error) {
+	if w.config.readOnly {
+		return 0, ErrReadOnly
 	}
+
+	entries, err := w.encode([][]byte{data})
 	if err != nil {
 		return 0, err
 	}
+	if !w.fits(entries) {
+		return 0, ErrRecordTooLarge
+	}
 
-	return id, nil
+	req := &appendRequest{entries: entries}
+	w.enqueue(req)
+
+	if req.err != nil {
+		return 0, req.err
+	}
+
+	return req.id, nil
 }
 
-// Read returns byte slice for record id and error if any
-func (w *WAL) Read(id uint64) ([]byte, error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// AppendBatch adds records to the log with a single sync, after a crash
+// either all or none of the records are recovered, it returns ids of
+// the first and the last record. If any of the records doesn't fit into
+// an empty segment none of them are written and ErrRecordTooLarge is returned
+func (w *WAL) AppendBatch(records [][]byte) (uint64, uint64, error) {
+	if w.config.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if len(records) == 0 {
+		return 0, 0, nil
+	}
 
-	if id < w.segments[0].idx.startID {
-		return nil, ErrRecordNotFound
+	entries, err := w.encode(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !w.fits(entries) {
+		return 0, 0, ErrRecordTooLarge
 	}
 
-	// determine correct segment
-	for i := 0; i < len(w.segments)-1; i++ {
-		ls := w.segments[i].idx.startID
-		rs := w.segments[i+1].idx.startID
+	req := &appendRequest{entries: entries}
+	w.enqueue(req)
+
+	if req.err != nil {
+		return 0, 0, req.err
+	}
+
+	return req.id, req.id + uint64(len(records)) - 1, nil
+}
 
-		if id >= ls && id < rs {
-			data, err := w.segments[i].read(id)
+// write appends entries to the log rolling segments when they are full
+// or older than MaxAge and returns id of the first record
+func (w *WAL) write(entries []entry) (uint64, error) {
+	var firstID uint64
+
+	expired, err := w.expired()
+	if err != nil {
+		return 0, err
+	}
+	if expired {
+		err = w.roll()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for len(entries) > 0 {
+		id, n, err := w.activeSegment.writeBatch(entries)
+		// no more space for index or store, create new one
+		if errors.Is(err, errNoIndexSpaceLeft) || errors.Is(err, errNoStoreSpaceLeft) {
+			if w.activeSegment.empty() {
+				return 0, err
+			}
+
+			err = w.roll()
 			if err != nil {
-				return nil, err
+				return 0, err
 			}
 
-			return data, nil
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if firstID == 0 {
+			firstID = id
 		}
+		entries = entries[n:]
+		w.unsynced += uint64(n)
 	}
 
-	data, err := w.activeSegment.read(id)
-	if err != nil {
-		return nil, err
+	return firstID, nil
+}
+
+// publish makes written records visible to readers and wakes up
+// everyone waiting for new records, a batch could span several segments
+// so every segment with unpublished records is published
+func (w *WAL) publish() {
+	for i := len(w.segments) - 1; i >= 0; i-- {
+		s := w.segments[i]
+		if s.idx.committedID() == s.idx.id {
+			break
+		}
+		s.idx.publish()
 	}
 
-	return data, nil
+	w.mu.Lock()
+	close(w.appended)
+	w.appended = make(chan struct{})
+	w.mu.Unlock()
 }
 
-func (w *WAL) Close() error {
-	err := w.activeSegment.idx.close()
+// appendedChan returns a channel that is closed on the next commit
+func (w *WAL) appendedChan() <-chan struct{} {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.appended
+}
+
+// roll seals active segment and starts a new one, the sealed segment is
+// synced with any policy because sync flushes only the active segment
+func (w *WAL) roll() error {
+	err := w.sync()
 	if err != nil {
 		return err
 	}
 
-	err = w.activeSegment.store.close()
+	nID := segmentName(w.activeSegment.idx.id)
+	indexPath := filepath.Join(w.dir, nID+".index")
+	storePath := filepath.Join(w.dir, nID+".store")
+	// files of a segment that failed to start are not left behind,
+	// the store goes first because a segment is discovered by it
+	removeFiles := func() {
+		_ = w.config.FS.Remove(storePath)
+		_ = w.config.FS.Remove(indexPath)
+	}
+
+	err = createFile(w.config.FS, indexPath)
+	if err != nil {
+		removeFiles()
+		return err
+	}
+	err = createFile(w.config.FS, storePath)
+	if err != nil {
+		removeFiles()
+		return err
+	}
+
+	nSeg, err := newSegment(indexPath, storePath,
+		w.activeSegment.idx.id, w.config)
+	if err != nil {
+		removeFiles()
+		return err
+	}
+
+	// records of the segment are lost with it if its files are not
+	// in the directory after a crash
+	err = w.config.FS.SyncDir(w.dir)
+	if err != nil {
+		_ = nSeg.release()
+		removeFiles()
+		return err
+	}
+
+	w.mu.Lock()
+	w.segments = append(w.segments, nSeg)
+	w.activeSegment = nSeg
+	w.mu.Unlock()
+	w.activeTime = 0
+
+	return nil
+}
+
+// maybeSync flushes the active segment if sync policy requires it
+func (w *WAL) maybeSync() error {
+	switch w.config.Sync.mode {
+	case syncAlways:
+		return w.sync()
+	case syncEveryN:
+		if w.unsynced >= w.config.Sync.n {
+			return w.sync()
+		}
+	}
+
+	return nil
+}
+
+// Sync flushes all appended records to disk
+func (w *WAL) Sync() error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	return w.sync()
+}
+
+func (w *WAL) sync() error {
+	if w.unsynced == 0 {
+		return nil
+	}
+
+	err := w.activeSegment.sync()
 	if err != nil {
 		return err
 	}
 
+	w.unsynced = 0
 	return nil
 }
 
-// Trim remove all segments that startID is less than id
+// syncLoop flushes the log every interval until the log is closed
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = w.Sync()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Read returns byte slice for record id and error if any
+func (w *WAL) Read(id uint64) ([]byte, error) {
+	s, err := w.acquireSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	data, h, err := s.readRecord(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.decode(data, h.flags)
+}
+
+// acquireSegment finds the segment that holds id and takes a reference
+// to it, so it's not closed by Trim while the record is read
+func (w *WAL) acquireSegment(id uint64) (*segment, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if id < w.firstID() {
+		return nil, ErrRecordNotFound
+	}
+
+	// determine correct segment
+	s := w.activeSegment
+	for i := 0; i < len(w.segments)-1; i++ {
+		if id < w.segments[i+1].idx.startID {
+			s = w.segments[i]
+			break
+		}
+	}
+
+	s.acquire()
+	return s, nil
+}
+
+// Close flushes the log and closes all segments, segments that are
+// being read are closed after readers are done, Close is idempotent
+func (w *WAL) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	w.wg.Wait()
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.sync()
+	for _, s := range w.segments {
+		rErr := s.release()
+		if err == nil {
+			err = rErr
+		}
+	}
+
+	if w.lock != nil {
+		rErr := w.lock.Close()
+		if err == nil {
+			err = rErr
+		}
+	}
+
+	return err
+}
+
+// Trim remove all segments that startID is less than id,
+// segments that are being read are closed after readers are done
 func (w *WAL) Trim(id uint64) error {
+	if w.config.readOnly {
+		return ErrReadOnly
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if w.closed {
+		return ErrClosed
+	}
+
+	return w.trim(id)
+}
+
+func (w *WAL) trim(id uint64) error {
 	var newSegments []*segment
 
 	for i := 0; i < len(w.segments)-1; i++ {
@@ -229,6 +793,11 @@ func (w *WAL) Trim(id uint64) error {
 				return err
 			}
 
+			err = w.segments[i].release()
+			if err != nil {
+				return err
+			}
+
 			continue
 		}
 		newSegments = append(newSegments, w.segments[i])
@@ -236,24 +805,243 @@ func (w *WAL) Trim(id uint64) error {
 
 	newSegments = append(newSegments, w.activeSegment)
 
+	removed := len(newSegments) < len(w.segments)
 	w.segments = newSegments
+
+	// removed segments come back after a crash if the directory is not synced
+	if removed {
+		return w.config.FS.SyncDir(w.dir)
+	}
+
 	return nil
 }
 
-func nextID(oldID string) string {
-	skip := 0
-	for i := 0; i < len(oldID); i++ {
-		if oldID[i] != '0' {
-			break
+// TruncateBefore removes all records before id, FirstID becomes id.
+// The low-water mark is persisted in the meta file, so records before id
+// that are left in the first segment are not visible after restart too,
+// segments that hold only such records are removed
+func (w *WAL) TruncateBefore(id uint64) error {
+	if w.config.readOnly {
+		return ErrReadOnly
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if id <= w.firstID() {
+		return nil
+	}
+	if id > w.activeSegment.idx.id {
+		return ErrRecordNotFound
+	}
+
+	err := writeMeta(w.config.FS, w.dir, meta{firstID: id})
+	if err != nil {
+		return err
+	}
+	w.lowWater = id
+
+	return w.trim(id)
+}
+
+// FirstID returns id of the first record in the log
+func (w *WAL) FirstID() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.firstID()
+}
+
+func (w *WAL) firstID() uint64 {
+	if w.lowWater > w.segments[0].idx.startID {
+		return w.lowWater
+	}
+
+	return w.segments[0].idx.startID
+}
+
+// TruncateAfter removes all records after id, id could be FirstID()-1 to
+// remove all of them. It's crash safe: newer segments are removed starting
+// from the last one and the segment with id is truncated after that, so
+// the log is always a valid prefix. If it fails appends fail with ErrFailed
+// until the log is reopened
+func (w *WAL) TruncateAfter(id uint64) error {
+	if w.config.readOnly {
+		return ErrReadOnly
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+
+	lastID := w.activeSegment.idx.id - 1
+	if id == lastID {
+		return nil
+	}
+	if id+1 < w.firstID() || id > lastID {
+		return ErrRecordNotFound
+	}
+
+	err := w.truncateAfter(id)
+	if err != nil {
+		// segments and records could be removed partially
+		w.failed = fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+
+	return err
+}
+
+func (w *WAL) truncateAfter(id uint64) error {
+	// the first segment is emptied if id is right before it
+	k := len(w.segments) - 1
+	for k > 0 && w.segments[k].idx.startID > id {
+		k--
+	}
+	seg := w.segments[k]
+
+	err := seg.endBatch(id)
+	if err != nil {
+		return err
+	}
+
+	removed := len(w.segments)-1 > k
+	for len(w.segments)-1 > k {
+		last := w.segments[len(w.segments)-1]
+		err := last.remove()
+		if err != nil {
+			return err
+		}
+		err = last.release()
+		if err != nil {
+			return err
 		}
-		skip++
+
+		w.segments = w.segments[:len(w.segments)-1]
+		w.activeSegment = seg
 	}
 
-	n, err := strconv.Atoi(oldID[skip:])
+	// removed segments come back after a crash if the directory is not synced
+	if removed {
+		err = w.config.FS.SyncDir(w.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = seg.truncateAfter(id)
 	if err != nil {
-		panic("creating new index is broken")
+		return err
+	}
+
+	// truncation synced what is left
+	w.unsynced = 0
+	w.activeTime = 0
+
+	return nil
+}
+
+// segmentFile is a segment found in the log directory
+type segmentFile struct {
+	name string
+	num  uint64
+	// legacy segments are named by a sequence number: 0001, 0002, ...
+	// others are named by their start id padded to 20 digits
+	legacy bool
+}
+
+// segmentName returns the name of a segment that starts with startID
+func segmentName(startID uint64) string {
+	return fmt.Sprintf("%020d", startID)
+}
+
+// listSegments returns segments in dir ordered by their start ids, legacy
+// segments go first because new segments are named by start ids only
+// after a log is opened by a version that supports such names
+func listSegments(fs FS, dir string) ([]segmentFile, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segmentFile
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".store") {
+			continue
+		}
+
+		name := strings.TrimSuffix(file, ".store")
+		num, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSegmentName, file)
+		}
+
+		// record ids start with one
+		legacy := len(name) != 20
+		if !legacy && num == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSegmentName, file)
+		}
+
+		segments = append(segments, segmentFile{
+			name:   name,
+			num:    num,
+			legacy: legacy,
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].legacy != segments[j].legacy {
+			return segments[i].legacy
+		}
+		return segments[i].num < segments[j].num
+	})
+
+	return segments, nil
+}
+
+// legacyStartID reads start id of a legacy segment from the index header
+// or the first index entry if there is no header, it returns zero if the
+// index is empty
+func legacyStartID(fs FS, indexPath string) (uint64, error) {
+	f, err := fs.OpenFile(indexPath, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	b := make([]byte, headerSize)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	if hasMagic(b[:n]) {
+		h, err := parseFileHeader(b[:n], indexKind)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", indexPath, err)
+		}
+		return h.startID, nil
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+	if n < 8 {
+		return 0, ErrIndexRecordID
 	}
 
-	newID := strconv.Itoa(n + 1)
-	return strings.Repeat("0", 4-len(newID)) + newID
+	return binary.BigEndian.Uint64(b[0:8]), nil
 }
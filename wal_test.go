@@ -2,24 +2,37 @@ package wal
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func BenchmarkWrite32(b *testing.B) {
 	benchmarkWrite([]byte("0123456789ABCDEF0123456789ABCDEF"), b)
 }
 
+func BenchmarkWrite32SyncNever(b *testing.B) {
+	benchmarkWriteSync([]byte("0123456789ABCDEF0123456789ABCDEF"), SyncNever, b)
+}
+
 func benchmarkWrite(msg []byte, b *testing.B) {
+	benchmarkWriteSync(msg, SyncAlways, b)
+}
+
+func benchmarkWriteSync(msg []byte, policy SyncPolicy, b *testing.B) {
 	b.StopTimer()
 	tempDir, _ := ioutil.TempDir("", "wal-bench")
 	defer os.RemoveAll(tempDir)
 	cfg := Config{}
 	cfg.Segment.MaxIndexSizeBytes = 4 * 2 << 20
 	cfg.Segment.MaxStoreSizeBytes = 16 * 2 << 20
+	cfg.Sync = policy
 	log, _ := New(tempDir, &cfg)
 
 	b.StartTimer()
@@ -52,12 +65,12 @@ func TestWalEmptyDir(t *testing.T) {
 	}
 
 	// should have default name is dir empty
-	_, err = os.Stat(tempDir + "/0001.index")
+	_, err = os.Stat(tempDir + "/" + segmentName(1) + ".index")
 	if err != nil {
 		t.Error("index file is missing")
 	}
 
-	_, err = os.Stat(tempDir + "/0001.store")
+	_, err = os.Stat(tempDir + "/" + segmentName(1) + ".store")
 	if err != nil {
 		t.Error("store file is missing")
 	}
@@ -173,28 +186,59 @@ func TestConcurrentAppends(t *testing.T) {
 	wg.Wait()
 }
 
-func TestNextID(t *testing.T) {
+func TestSegmentName(t *testing.T) {
 	type test struct {
-		input string
+		input uint64
 		want  string
 	}
 
 	tests := []test{
-		{"0001", "0002"},
-		{"0009", "0010"},
-		{"0099", "0100"},
-		{"0999", "1000"},
-		{"1000", "1001"},
+		{1, "00000000000000000001"},
+		{10000, "00000000000000010000"},
+		{1<<64 - 1, "18446744073709551615"},
 	}
 
 	for _, tc := range tests {
-		got := nextID(tc.input)
+		got := segmentName(tc.input)
 		if got != tc.want {
 			t.Errorf("%s != %s", got, tc.want)
 		}
 	}
 }
 
+func TestListSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-list-segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{
+		segmentName(10001), "10000", segmentName(9), "0002", "9999", "0001", segmentName(100),
+	}
+	for _, name := range names {
+		err := ioutil.WriteFile(dir+"/"+name+".store", nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := listSegments(OSFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"0001", "0002", "9999", "10000", segmentName(9), segmentName(100), segmentName(10001)}
+	if len(segments) != len(want) {
+		t.Fatalf("should find %d segments, got %d", len(want), len(segments))
+	}
+	for i, s := range segments {
+		if s.name != want[i] {
+			t.Errorf("segment %d should be %s, got %s", i, want[i], s.name)
+		}
+	}
+}
+
 func TestReadWriteWithNewSegment(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "append-segment")
 	defer os.RemoveAll(dir)
@@ -207,8 +251,8 @@ func TestReadWriteWithNewSegment(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if wal.activeSegment.segmentID != "0001" {
-		t.Error("first segment should be 0001")
+	if wal.activeSegment.segmentID != segmentName(1) {
+		t.Error("first segment should start with 1")
 	}
 
 	records := []string{
@@ -230,8 +274,8 @@ func TestReadWriteWithNewSegment(t *testing.T) {
 		}
 		ids = append(ids, id)
 
-		if wal.activeSegment.segmentID != "0001" {
-			t.Error("first segment should be 0001")
+		if wal.activeSegment.segmentID != segmentName(1) {
+			t.Error("first segment should start with 1")
 		}
 	}
 
@@ -242,8 +286,8 @@ func TestReadWriteWithNewSegment(t *testing.T) {
 		}
 		ids = append(ids, id)
 
-		if wal.activeSegment.segmentID != "0002" {
-			t.Error("second segment should be 0002")
+		if wal.activeSegment.segmentID != segmentName(3) {
+			t.Error("second segment should start with 3")
 		}
 	}
 
@@ -254,8 +298,8 @@ func TestReadWriteWithNewSegment(t *testing.T) {
 		}
 		ids = append(ids, id)
 
-		if wal.activeSegment.segmentID != "0003" {
-			t.Error("third segment should be 0003")
+		if wal.activeSegment.segmentID != segmentName(5) {
+			t.Error("third segment should start with 5")
 		}
 	}
 
@@ -310,27 +354,1364 @@ func TestReadWriteWithNewSegment(t *testing.T) {
 		t.Error(err)
 	}
 
-	if len(wal.segments) != 2 || wal.segments[0].segmentID != "0003" || wal.segments[1].segmentID != "0004" {
+	if len(wal.segments) != 2 || wal.segments[0].segmentID != segmentName(5) || wal.segments[1].segmentID != segmentName(7) {
 		t.Error("should remove two first segment")
 	}
 
-	for i := 1; i <= 2; i++ {
-		_, err := os.Stat(fmt.Sprintf("%s/000%d.index", wal.dir, i))
+	for _, i := range []uint64{1, 3} {
+		_, err := os.Stat(fmt.Sprintf("%s/%s.index", wal.dir, segmentName(i)))
 		if err == nil {
 			t.Error("index is not deleted")
 		}
-		_, err = os.Stat(fmt.Sprintf("%s/000%d.store", wal.dir, i))
+		_, err = os.Stat(fmt.Sprintf("%s/%s.store", wal.dir, segmentName(i)))
 		if err == nil {
 			t.Error("store is not deleted")
 		}
 	}
 
-	_, err = os.Stat(fmt.Sprintf("%s/000%d.store", wal.dir, 3))
+	_, err = os.Stat(fmt.Sprintf("%s/%s.store", wal.dir, segmentName(5)))
+	if err != nil {
+		t.Error("third store should stay")
+	}
+	_, err = os.Stat(fmt.Sprintf("%s/%s.index", wal.dir, segmentName(5)))
+	if err != nil {
+		t.Error("third index should stay")
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []string{"first", "second", "third"}
+	for _, r := range records {
+		_, err := wal.Append([]byte(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeSize := wal.activeSegment.store.size
+	_ = wal.Close()
+
+	// half written record that never made it to the index
+	f, err := os.OpenFile(dir+"/"+segmentName(1)+".store", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(appendRecord(nil, []byte("fourth"), 0)[:10])
+	_ = f.Close()
+
+	wal, err = New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := wal.Recovery()
+	if report.DroppedRecords != 0 || report.TruncatedBytes != 10 {
+		t.Errorf("wrong recovery report: %+v", report)
+	}
+	if wal.activeSegment.store.size != storeSize {
+		t.Error("store should be truncated to the last record")
+	}
+
+	id, err := wal.Append([]byte("fourth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 {
+		t.Errorf("id should be 4, got %d", id)
+	}
+	_ = wal.Close()
+
+	// cut the last record in half, index entry points at incomplete record
+	err = os.Truncate(dir+"/"+segmentName(1)+".store", int64(storeSize)+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report = wal.Recovery()
+	if report.DroppedRecords != 1 || report.TruncatedBytes != 3 {
+		t.Errorf("wrong recovery report: %+v", report)
+	}
+
+	_, err = wal.Read(4)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Error("dropped record should not be found")
+	}
+
+	for i, r := range records {
+		data, err := wal.Read(uint64(i + 1))
+		if err != nil {
+			t.Error(err)
+		}
+		if string(data) != r {
+			t.Error("read is not right")
+		}
+	}
+
+	id, err = wal.Append([]byte("fourth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 {
+		t.Errorf("id should be 4, got %d", id)
+	}
+}
+
+func TestRecoverUnindexedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-recover-unindexed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = wal.Close()
+
+	// entry of record 4 is torn and entry of record 5 didn't make it
+	// to the index, record 6 is in the store only and record 7 is torn
+	idx, err := os.OpenFile(dir+"/"+segmentName(1)+".index", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := make([]byte, 32)
+	binary.BigEndian.PutUint64(torn[0:8], 99)
+	_, err = idx.WriteAt(torn, headerSize+3*16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = idx.Close()
+
+	f, err := os.OpenFile(dir+"/"+segmentName(1)+".store", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(appendRecord(nil, []byte("r6"), 0))
+	_, _ = f.Write(appendRecord(nil, []byte("r7"), 0)[:10])
+	_ = f.Close()
+
+	wal, err = New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	report := wal.Recovery()
+	if report.DroppedRecords != 0 || report.IndexedRecords != 3 || report.TruncatedBytes != 10 {
+		t.Errorf("wrong recovery report: %+v", report)
+	}
+	if wal.LastID() != 6 {
+		t.Errorf("valid records should be kept, last id %d", wal.LastID())
+	}
+	for i := uint64(1); i <= 6; i++ {
+		data, err := wal.Read(i)
+		if err != nil || string(data) != fmt.Sprintf("r%d", i) {
+			t.Errorf("wrong record %d: %q, %v", i, data, err)
+		}
+	}
+
+	id, err := wal.Append([]byte("r7"))
+	if err != nil || id != 7 {
+		t.Errorf("append after recovery should get id 7, got %d, %v", id, err)
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig
+	cfg.Sync = SyncEveryN(3)
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := wal.Append([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wal.unsynced != 2 {
+		t.Errorf("should have 2 unsynced appends, got %d", wal.unsynced)
+	}
+
+	_, err = wal.Append([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.unsynced != 0 {
+		t.Error("third append should sync")
+	}
+	_ = wal.Close()
+
+	cfg.Sync = SyncNever
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wal.Append([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.unsynced != 1 {
+		t.Error("append should not sync")
+	}
+
+	err = wal.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.unsynced != 0 {
+		t.Error("explicit sync should flush")
+	}
+	_ = wal.Close()
+
+	cfg.Sync = SyncInterval(time.Millisecond)
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	_, err = wal.Append([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		wal.writeMu.Lock()
+		unsynced := wal.unsynced
+		wal.writeMu.Unlock()
+
+		if unsynced == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background sync didn't flush the log")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for id := uint64(1); id <= 5; id++ {
+		data, err := wal.Read(id)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(data) != "data" {
+			t.Error("read is not right")
+		}
+	}
+}
+
+func TestSyncNeverRoll(t *testing.T) {
+	cfg := Config{Sync: SyncNever}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	fs := newFaultFS(0)
+	cfg.FS = fs
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wal.SegmentCount() != 3 {
+		t.Fatalf("records should span 3 segments, got %d", wal.SegmentCount())
+	}
+
+	err = wal.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sealed segments are on disk as well as the active one
+	cfg.FS = fs.recover(dropUnsynced)
+	wal, err = New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	if wal.FirstID() != 1 || wal.LastID() != 5 {
+		t.Errorf("wrong id range %d-%d", wal.FirstID(), wal.LastID())
+	}
+	for i := uint64(1); i <= 5; i++ {
+		data, err := wal.Read(i)
+		if err != nil || string(data) != fmt.Sprintf("r%d", i) {
+			t.Errorf("synced record %d is lost: %q, %v", i, data, err)
+		}
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wal.Append([]byte("single"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := [][]byte{[]byte("b1"), []byte("b2"), []byte("b3"), []byte("b4")}
+	first, last, err := wal.AppendBatch(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 2 || last != 5 {
+		t.Errorf("batch ids should be 2-5, got %d-%d", first, last)
+	}
+
+	// batch spans all three segments
+	if len(wal.segments) != 3 {
+		t.Fatalf("should have 3 segments, got %d", len(wal.segments))
+	}
+
+	for i, r := range records {
+		data, err := wal.Read(first + uint64(i))
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, r) {
+			t.Error("read is not right")
+		}
+	}
+	_ = wal.Close()
+
+	// the last record of the batch is lost
+	err = os.Truncate(dir+"/"+segmentName(5)+".store", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = New(dir, &cfg)
 	if err != nil {
-		t.Error("0003.store should stay")
+		t.Fatal(err)
 	}
-	_, err = os.Stat(fmt.Sprintf("%s/000%d.index", wal.dir, 3))
+
+	report := wal.Recovery()
+	if report.DroppedRecords != 4 || report.RemovedSegments != 2 || report.Segment != segmentName(1) {
+		t.Errorf("wrong recovery report: %+v", report)
+	}
+	if len(wal.segments) != 1 {
+		t.Error("segments of incomplete batch should be removed")
+	}
+
+	data, err := wal.Read(1)
+	if err != nil || string(data) != "single" {
+		t.Error("record before the batch should stay")
+	}
+	for id := first; id <= last; id++ {
+		_, err := wal.Read(id)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("record %d of incomplete batch should be dropped", id)
+		}
+	}
+
+	id, err := wal.Append([]byte("next"))
 	if err != nil {
-		t.Error("0003.index should stay")
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Errorf("id should be 2, got %d", id)
+	}
+}
+
+func TestFailedBatchIsUndone(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	// fail every operation of a batch that spans segments in turn
+	for n := 1; ; n++ {
+		fs := newFaultFS(0)
+		cfg.FS = fs
+
+		wal, err := New("/wal", &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wal.Append([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs.failAfter(n)
+		_, _, err = wal.AppendBatch([][]byte{[]byte("b1"), []byte("b2"), []byte("b3")})
+		if err == nil {
+			_ = wal.Close()
+			break
+		}
+		if !errors.Is(err, errFault) {
+			t.Fatalf("operation %d: unexpected error %v", n, err)
+		}
+
+		id, err := wal.Append([]byte("c"))
+		if err != nil || id != 2 {
+			t.Fatalf("operation %d: append after a failed batch should get id 2, got %d, %v", n, id, err)
+		}
+
+		// the log is the same after it's reopened
+		for i := 0; i < 2; i++ {
+			if wal.LastID() != 2 || wal.SegmentCount() != 1 {
+				t.Fatalf("operation %d: failed batch should be undone, last id %d, %d segments", n, wal.LastID(), wal.SegmentCount())
+			}
+			data, err := wal.Read(2)
+			if err != nil || string(data) != "c" {
+				t.Fatalf("operation %d: wrong record 2: %q, %v", n, data, err)
+			}
+
+			err = wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wal, err = New("/wal", &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = wal.Close()
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-truncate-after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wal.Append([]byte("r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = wal.AppendBatch([][]byte{[]byte("r2"), []byte("r3"), []byte("r4"), []byte("r5"), []byte("r6")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.TruncateAfter(100)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Error("should not truncate after missing record")
+	}
+	err = wal.TruncateAfter(6)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// cut the batch in the middle of the second segment
+	err = wal.TruncateAfter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wal.segments) != 2 || wal.activeSegment.segmentID != segmentName(3) {
+		t.Error("third segment should be removed")
+	}
+	_, err = os.Stat(dir + "/" + segmentName(5) + ".store")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("store of removed segment should be deleted")
+	}
+
+	_, err = wal.Read(4)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Error("truncated record should not be found")
+	}
+	_ = wal.Close()
+
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remaining part of the batch is not an incomplete batch
+	if wal.Recovery().DroppedRecords != 0 {
+		t.Errorf("nothing should be dropped: %+v", wal.Recovery())
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		data, err := wal.Read(i)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(data) != fmt.Sprintf("r%d", i) {
+			t.Error("read is not right")
+		}
+	}
+
+	id, err := wal.Append([]byte("r4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 {
+		t.Errorf("id should be 4, got %d", id)
+	}
+}
+
+func TestTruncateAfterAll(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	cfg.FS = NewMemFS()
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wal.TruncateAfter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.FirstID() != 1 || wal.LastID() != 0 || wal.SegmentCount() != 1 {
+		t.Errorf("log should be empty, ids %d-%d, %d segments", wal.FirstID(), wal.LastID(), wal.SegmentCount())
+	}
+	_, err = wal.Read(1)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("truncated record should not be found, got %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		id, err := wal.Append([]byte(fmt.Sprintf("n%d", i)))
+		if err != nil || id != uint64(i) {
+			t.Fatalf("append after truncation should get id %d, got %d, %v", i, id, err)
+		}
+	}
+
+	// records before the first id stay hidden
+	err = wal.TruncateBefore(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.TruncateAfter(1)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("should not truncate before the first id, got %v", err)
+	}
+	err = wal.TruncateAfter(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	if wal.FirstID() != 3 || wal.LastID() != 2 {
+		t.Errorf("log should be empty after reopen, ids %d-%d", wal.FirstID(), wal.LastID())
+	}
+	id, err := wal.Append([]byte("n3"))
+	if err != nil || id != 3 {
+		t.Errorf("append should get id 3, got %d, %v", id, err)
+	}
+	data, err := wal.Read(3)
+	if err != nil || string(data) != "n3" {
+		t.Errorf("wrong record 3: %q, %v", data, err)
+	}
+}
+
+func TestTruncateDurable(t *testing.T) {
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+	fs := newFaultFS(0)
+	cfg.FS = fs
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 8; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wal.TruncateAfter(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.TruncateBefore(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// removed segments don't come back after a crash
+	cfg.FS = fs.recover(dropUnsynced)
+	wal, err = New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	if wal.FirstID() != 3 || wal.LastID() != 6 || wal.SegmentCount() != 2 {
+		t.Errorf("wrong log after crash: ids %d-%d, %d segments", wal.FirstID(), wal.LastID(), wal.SegmentCount())
+	}
+	_, err = wal.Read(7)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("truncated record should not be found, got %v", err)
+	}
+}
+
+func TestTruncateBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-truncate-before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wal.TruncateBefore(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wal.FirstID() != 4 {
+		t.Errorf("first id should be 4, got %d", wal.FirstID())
+	}
+	if len(wal.segments) != 2 || wal.segments[0].segmentID != segmentName(3) {
+		t.Error("first segment should be removed")
+	}
+
+	check := func(w *WAL) {
+		_, err := w.Read(3)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Error("record before first id should not be found")
+		}
+		_, err = w.NewIterator(3)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Error("should not iterate before first id")
+		}
+
+		for i := uint64(4); i <= 5; i++ {
+			data, err := w.Read(i)
+			if err != nil {
+				t.Error(err)
+			}
+			if string(data) != fmt.Sprintf("r%d", i) {
+				t.Error("read is not right")
+			}
+		}
+	}
+	check(wal)
+	_ = wal.Close()
+
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wal.FirstID() != 4 {
+		t.Errorf("first id should be 4 after restart, got %d", wal.FirstID())
+	}
+	check(wal)
+
+	err = wal.TruncateBefore(7)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Error("should not truncate past the end of the log")
+	}
+}
+
+func TestReadDuringAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-read-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// writer is busy, e.g. waiting for fsync
+	wal.writeMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(1); i <= 3; i++ {
+			data, err := wal.Read(i)
+			if err != nil || string(data) != fmt.Sprintf("r%d", i) {
+				t.Error("read is not right")
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read is blocked by the writer")
+	}
+	wal.writeMu.Unlock()
+
+	// reader keeps the segment open while it's trimmed
+	s, err := wal.acquireSegment(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Trim(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, h, err := s.readRecord(1)
+	if err == nil {
+		data, err = wal.decode(data, h.flags)
+	}
+	if err != nil || string(data) != "r1" {
+		t.Errorf("trimmed segment should be readable until released: %v", err)
+	}
+
+	err = s.release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.store.file.Stat()
+	if !errors.Is(err, os.ErrClosed) {
+		t.Error("segment should be closed after the last reference is released")
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := wal.Append([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := wal.segments
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Error("second close should be no-op")
+	}
+
+	for _, s := range segments {
+		_, err := s.store.file.Stat()
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("store of segment %s should be closed", s.segmentID)
+		}
+		_, err = s.idx.idxFile.Stat()
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("index of segment %s should be closed", s.segmentID)
+		}
+		if s.idx.mm != nil {
+			t.Errorf("index of segment %s should be unmapped", s.segmentID)
+		}
+	}
+
+	_, err = wal.Append([]byte("data"))
+	if !errors.Is(err, ErrClosed) {
+		t.Error("append should return ErrClosed")
+	}
+	_, err = wal.Read(1)
+	if !errors.Is(err, ErrClosed) {
+		t.Error("read should return ErrClosed")
+	}
+	_, err = wal.NewIterator(1)
+	if !errors.Is(err, ErrClosed) {
+		t.Error("iterator should return ErrClosed")
+	}
+	err = wal.Trim(1)
+	if !errors.Is(err, ErrClosed) {
+		t.Error("trim should return ErrClosed")
+	}
+}
+
+func TestOpenLegacySegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexSizeBytes = 32
+	cfg.Segment.MaxStoreSizeBytes = 1024
+
+	wal, err := New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = wal.Close()
+
+	// segments named by sequence numbers
+	for i, startID := range []uint64{1, 3, 5} {
+		for _, ext := range []string{".index", ".store"} {
+			err := os.Rename(dir+"/"+segmentName(startID)+ext, fmt.Sprintf("%s/%04d%s", dir, i+1, ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(w *WAL, last uint64) {
+		for i := uint64(1); i <= last; i++ {
+			data, err := w.Read(i)
+			if err != nil {
+				t.Error(err)
+			}
+			if string(data) != fmt.Sprintf("r%d", i) {
+				t.Error("read is not right")
+			}
+		}
+	}
+
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(wal, 5)
+
+	for i := 6; i <= 7; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wal.activeSegment.segmentID != segmentName(7) {
+		t.Errorf("new segment should be named by start id, got %s", wal.activeSegment.segmentID)
+	}
+	_ = wal.Close()
+
+	wal, err = New(dir, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	check(wal, 7)
+	if wal.LastID() != 7 {
+		t.Errorf("last id should be 7, got %d", wal.LastID())
+	}
+}
+
+func TestOpenInvalidSegmentNames(t *testing.T) {
+	for _, name := range []string{"segment", segmentName(0), "-1"} {
+		dir, err := ioutil.TempDir("", "wal-invalid-name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		err = ioutil.WriteFile(dir+"/"+name+".store", nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(dir+"/"+name+".index", nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(dir, nil)
+		if !errors.Is(err, ErrInvalidSegmentName) {
+			t.Errorf("%s: should return ErrInvalidSegmentName, got %v", name, err)
+		}
+	}
+}
+
+func TestReadCorruptedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-corrupted-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := wal.Append([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another process overwrites the index entry of the second record
+	f, err := os.OpenFile(dir+"/"+segmentName(1)+".index", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, headerSize+16)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wal.Read(2)
+	if !errors.Is(err, ErrCorruptIndex) {
+		t.Errorf("should return ErrCorruptIndex, got %v", err)
+	}
+
+	data, err := wal.Read(3)
+	if err != nil || string(data) != "data" {
+		t.Errorf("other records should be readable, got %q, %v", data, err)
+	}
+}
+
+func TestOpenCorruptedIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// slot is the index entry of the first segment that is overwritten
+		slot  int
+		entry []byte
+		// sealed is set if the first segment is sealed
+		sealed bool
+	}{
+		// entries after the lost one are left in a sealed segment
+		{"sealed lost", 1, make([]byte, 16), true},
+		// entries after the overwritten one are left in the active
+		// segment, they are indexed again from the store
+		{"active", 1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+		// entries after the overwritten one are left in a sealed segment
+		{"sealed stale", 1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true},
+		// the last entry of a sealed segment is lost
+		{"sealed", 3, make([]byte, 16), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{}
+			cfg.Segment.MaxIndexSizeBytes = 64
+			cfg.Segment.MaxStoreSizeBytes = 1024
+			cfg.FS = NewMemFS()
+
+			wal, err := New("/wal", &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records := 3
+			if tt.sealed {
+				records = 6
+			}
+			for i := 0; i < records; i++ {
+				_, err := wal.Append([]byte("data"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := cfg.FS.OpenFile("/wal/"+segmentName(1)+".index", os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.WriteAt(tt.entry, int64(headerSize+tt.slot*16))
+			_ = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wal, err = New("/wal", &cfg)
+			if tt.sealed {
+				if !errors.Is(err, ErrCorruptIndex) {
+					t.Errorf("should return ErrCorruptIndex, got %v", err)
+				}
+
+				// both report the file offset of data after the end
+				report, vErr := VerifyFS(cfg.FS, "/wal")
+				if vErr != nil {
+					t.Fatal(vErr)
+				}
+				for _, p := range report.Problems {
+					msg := p.Err.Error()
+					if strings.Contains(msg, "after the last entry") && !strings.HasSuffix(err.Error(), msg) {
+						t.Errorf("New and Verify report different offsets: %v, %v", err, p.Err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+
+			if wal.Recovery().IndexedRecords != 2 || wal.LastID() != 3 {
+				t.Errorf("records should be indexed again: %+v, last id %d", wal.Recovery(), wal.LastID())
+			}
+		})
+	}
+}
+
+func TestRecoverLostIndexPage(t *testing.T) {
+	cfg := Config{Sync: SyncNever}
+	cfg.Segment.MaxIndexSizeBytes = 16 * 1024
+	cfg.Segment.MaxStoreSizeBytes = 1024 * 1024
+	cfg.FS = NewMemFS()
+
+	wal, err := New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 300; i++ {
+		_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the page with entries of records 201..256 didn't make it to disk,
+	// the pages before and after it did
+	f, err := cfg.FS.OpenFile("/wal/"+segmentName(1)+".index", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(make([]byte, 56*16), headerSize+200*16)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = New("/wal", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	if wal.Recovery().IndexedRecords != 100 || wal.LastID() != 300 {
+		t.Errorf("records should be indexed again: %+v, last id %d", wal.Recovery(), wal.LastID())
+	}
+	for i := uint64(1); i <= 300; i++ {
+		data, err := wal.Read(i)
+		if err != nil || string(data) != fmt.Sprintf("r%d", i) {
+			t.Fatalf("wrong record %d: %q, %v", i, data, err)
+		}
+	}
+}
+
+// countingFS counts files that are open
+type countingFS struct {
+	FS
+
+	mu   sync.Mutex
+	open int
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	fs.open++
+	fs.mu.Unlock()
+
+	return &countedFile{File: f, fs: fs}, nil
+}
+
+type countedFile struct {
+	File
+	fs *countingFS
+}
+
+func (f *countedFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		f.fs.mu.Lock()
+		f.fs.open--
+		f.fs.mu.Unlock()
+	}
+
+	return err
+}
+
+func TestOpenFailureReleasesSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt makes the closed log fail to open
+		corrupt func(w *WAL, fs FS) error
+	}{
+		{"timestamp", func(w *WAL, fs FS) error {
+			// the record is too short to hold its time
+			_, _, err := w.activeSegment.writeBatch([]entry{{data: []byte("ts"), flags: flagTimestamp}})
+			return err
+		}},
+		{"meta", func(w *WAL, fs FS) error {
+			f, err := fs.OpenFile("/wal/"+metaFile, os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt([]byte("corrupted"), 0)
+			if cErr := f.Close(); err == nil {
+				err = cErr
+			}
+
+			return err
+		}},
+		{"recovery", func(w *WAL, fs FS) error {
+			// the store has a record after the index is full
+			s := w.activeSegment
+			for s.idx.free() > 0 {
+				_, err := s.write([]byte("data"))
+				if err != nil {
+					return err
+				}
+			}
+			f, err := fs.OpenFile("/wal/"+segmentName(s.idx.startID)+".store", os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt(appendRecord(nil, []byte("data"), 0), int64(s.store.size))
+			if cErr := f.Close(); err == nil {
+				err = cErr
+			}
+
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &countingFS{FS: NewMemFS()}
+			cfg := Config{FS: fs}
+			cfg.Segment.MaxIndexSizeBytes = 64
+			cfg.Segment.MaxStoreSizeBytes = 1024
+
+			wal, err := New("/wal", &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				_, err := wal.Append([]byte("data"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if wal.SegmentCount() < 2 {
+				t.Fatalf("records should span several segments")
+			}
+			err = tt.corrupt(wal, fs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = New("/wal", &cfg)
+			if err == nil {
+				t.Fatal("log should fail to open")
+			}
+			if fs.open != 0 {
+				t.Errorf("%d files are left open", fs.open)
+			}
+		})
+	}
+}
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name string
+		// lostRecord is set if the last record of the first store is torn
+		lostRecord bool
+		lastID     uint64
+		report     RecoveryReport
+	}{
+		{"index", false, 10, RecoveryReport{IndexedRecords: 3}},
+		{"store", true, 3, RecoveryReport{IndexedRecords: 2, TruncatedBytes: 12, DroppedRecords: 6, RemovedSegments: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{}
+			cfg.Segment.MaxIndexSizeBytes = 64
+			cfg.Segment.MaxStoreSizeBytes = 1024
+			cfg.FS = NewMemFS()
+
+			wal, err := New("/wal", &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 10; i++ {
+				_, err := wal.Append([]byte(fmt.Sprintf("r%d", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			storeSize := wal.segments[0].store.size
+			err = wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the second entry of the sealed segment is lost
+			f, err := cfg.FS.OpenFile("/wal/"+segmentName(1)+".index", os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.WriteAt(make([]byte, 16), headerSize+16)
+			_ = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.lostRecord {
+				f, err := cfg.FS.OpenFile("/wal/"+segmentName(1)+".store", os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = f.Truncate(int64(storeSize) - 10)
+				_ = f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = New("/wal", &cfg)
+			if !errors.Is(err, ErrCorruptIndex) {
+				t.Fatalf("should return ErrCorruptIndex, got %v", err)
+			}
+
+			wal, err = Repair("/wal", &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+
+			tt.report.Segment = wal.activeSegment.segmentID
+			if wal.Recovery() != tt.report {
+				t.Errorf("wrong recovery report: %+v, expected %+v", wal.Recovery(), tt.report)
+			}
+			if wal.LastID() != tt.lastID {
+				t.Errorf("last id should be %d, got %d", tt.lastID, wal.LastID())
+			}
+			for i := uint64(1); i <= wal.LastID(); i++ {
+				data, err := wal.Read(i)
+				if err != nil || string(data) != fmt.Sprintf("r%d", i) {
+					t.Errorf("wrong record %d: %q, %v", i, data, err)
+				}
+			}
+		})
 	}
 }